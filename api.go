@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// apiArticle is what /api/v1/article says about an article.
+type apiArticle struct {
+	URL      string `json:"url"`
+	FinalURL string `json:"final_url"`
+	Title    string `json:"title"`
+	Content  string `json:"content"`
+}
+
+var (
+	errArticleRefused = errors.New("articles from this host are not allowed here")
+	errInvalidURL     = errors.New("invalid url")
+	errUnknownFeed    = errors.New("unknown feed type")
+)
+
+// registerRoutes sets up everything the server answers to.
+func registerRoutes(mux *http.ServeMux, c *config) {
+	// Subscriptions from before /feed existed still have to work
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("/feed", feedHandler)
+
+	mux.HandleFunc("/api/v1/article", logRequests("api", apiArticleHandler))
+	mux.HandleFunc("/api/v1/discover", logRequests("api", apiDiscoverHandler))
+	mux.HandleFunc("/api/v1/feed", logRequests("api", apiFeedHandler))
+
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/preview", previewHandler)
+	mux.HandleFunc("/opml", opmlHandler)
+	mux.HandleFunc("/sign", signHandler)
+	mux.HandleFunc("/f/", tokenHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	if c.Debug {
+		mux.HandleFunc("/debug/extract", debugExtractHandler)
+	}
+}
+
+// rootHandler serves the static assets, and feeds for any URLs that still
+// point at the root.
+func rootHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if _, ok := q["url"]; ok || q.Get("bundle") != "" {
+		feedHandler(w, req)
+		return
+	}
+
+	staticHandler.ServeHTTP(w, req)
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	out, err := jsonEncode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(out + "\n"))
+}
+
+// apiRequest does what every API call needs before fetching anything: it
+// finds the URL the call is about, and checks that the client may have it
+// fetched. When it may, release must be called once the call is done;
+// otherwise, the client has already been told why not. Fetches for the call
+// have to be made with ctx.
+func apiRequest(w http.ResponseWriter, req *http.Request, hosts hostPatterns, refused error) (ctx context.Context, u *url.URL, release func(), ok bool) {
+	req.ParseForm()
+
+	if getConfig().SignedOnly {
+		apiError(w, http.StatusForbidden, errUnsigned)
+		return
+	}
+
+	u, err := parseFeedURL(req.FormValue("url"))
+	if err != nil || u.Host == "" {
+		apiError(w, http.StatusBadRequest, errInvalidURL)
+		return
+	}
+
+	requestLogFrom(req.Context()).setURLs([]string{u.String()})
+
+	if !hosts.allows(u) {
+		apiError(w, http.StatusForbidden, refused)
+		return
+	}
+
+	ctx, release, ok = admitRequest(w, req, requestKeyHash(req), []string{u.Host})
+	return
+}
+
+// apiArticleHandler extracts a single article.
+func apiArticleHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, u, release, ok := apiRequest(w, req, getConfig().ArticleHosts, errArticleRefused)
+	if !ok {
+		return
+	}
+	defer release()
+
+	a := getArticle(ctx, u.String(), nil)
+	if a == nil {
+		apiError(w, http.StatusBadGateway, errNoArticle)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiArticle{
+		URL:      u.String(),
+		FinalURL: a.FinalURL,
+		Title:    a.Title,
+		Content:  a.Content,
+	})
+}
+
+// apiDiscoverHandler lists the feeds a page offers, best first.
+func apiDiscoverHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, u, release, ok := apiRequest(w, req, getConfig().FeedHosts, errFeedRefused)
+	if !ok {
+		return
+	}
+	defer release()
+
+	cands, err := discoverFeeds(ctx, u)
+	if err != nil {
+		apiError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	if cands == nil {
+		cands = []feedCandidate{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"feeds": cands,
+	})
+}
+
+// apiFeedHandler serves a feed, processed just like /feed would, as a JSON
+// Feed no matter what it started as. It takes the same options as /feed,
+// for a single url.
+func apiFeedHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, u, release, ok := apiRequest(w, req, getConfig().FeedHosts, errFeedRefused)
+	if !ok {
+		return
+	}
+	defer release()
+
+	fr, err := parseFeedRequest(req, u)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Tracking pixels have no business in an API
+	fr.t.disabled = true
+
+	f, redirectURL, err := fetchFeed(ctx, fr)
+	if mf, ok := err.(*multipleFeedsError); ok {
+		writeJSON(w, http.StatusMultipleChoices, map[string]interface{}{
+			"error": err.Error(),
+			"feeds": mf.feeds,
+		})
+		return
+	}
+
+	if err == errFeedRefused {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if err != nil {
+		apiError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	if redirectURL != "" {
+		q := req.URL.Query()
+		q.Set("url", redirectURL)
+		req.URL.RawQuery = q.Encode()
+		http.Redirect(w, req, req.URL.String(), http.StatusFound)
+		return
+	}
+
+	var jf *JSONFeed
+	switch f := f.(type) {
+	case *Rss:
+		processRss(ctx, f, fr)
+		jf = rssToJSONFeed(f)
+	case *Atom:
+		processAtom(ctx, f, fr)
+		jf = atomToJSONFeed(f)
+	case *JSONFeed:
+		processJSONFeed(ctx, f, fr)
+		jf = f
+	default:
+		apiError(w, http.StatusBadGateway, errUnknownFeed)
+		return
+	}
+
+	jf.FeedUrl = u.String()
+	writeJSON(w, http.StatusOK, jf)
+}
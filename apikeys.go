@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// An apiKey lets a client use the server when keys are required. Only a hash
+// of the key itself is ever stored.
+type apiKey struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// Feed requests a day; 0 is unlimited
+	Quota int `json:"quota,omitempty"`
+
+	// Feeds may only come from these domains or their subdomains; empty
+	// allows any
+	Domains []string `json:"domains,omitempty"`
+}
+
+// keyUsage counts a key's requests on a given (UTC) day.
+type keyUsage struct {
+	day   string
+	count int
+}
+
+type apiKeyCtxKey struct{}
+
+const (
+	apiKeyBytes   = 16
+	apiKeyPathPfx = "/k/"
+)
+
+var (
+	errNoAPIKeys      = errors.New("no api_keys file configured")
+	errUnknownAPIKey  = errors.New("unknown key")
+	errDuplicateKey   = errors.New("a key with that name already exists")
+	errAPIKeyRequired = errors.New("api key required")
+
+	apiKeysFile = ""
+	requireKey  = false
+
+	keyUsageMtx sync.Mutex
+	keyUsages   = map[string]*keyUsage{}
+)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// readAPIKeys reads a JSON object mapping key hashes to keys. A missing file
+// holds no keys.
+func readAPIKeys(path string) (map[string]*apiKey, error) {
+	keys := map[string]*apiKey{}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func writeAPIKeys(path string, keys map[string]*apiKey) error {
+	b, err := json.MarshalIndent(keys, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+func lookupAPIKey(hash string) *apiKey {
+	return getConfig().apiKeys[hash]
+}
+
+// requestAPIKey finds the key a request was made with: feed readers can't
+// send headers, so it's either in the path, as /k/<key>/, or in ?key=.
+func requestAPIKey(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, apiKeyPathPfx) {
+		key := strings.TrimPrefix(req.URL.Path, apiKeyPathPfx)
+		if i := strings.Index(key, "/"); i >= 0 {
+			key = key[:i]
+		}
+
+		return key
+	}
+
+	return req.FormValue("key")
+}
+
+// requestKeyHash is the hash of the request's key, if it has one.
+func requestKeyHash(req *http.Request) string {
+	key := requestAPIKey(req)
+	if key == "" {
+		return ""
+	}
+
+	return hashAPIKey(key)
+}
+
+// allowsHost checks that a key may fetch feeds from host.
+func (k *apiKey) allowsHost(host string) bool {
+	if len(k.Domains) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, d := range k.Domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// useQuota counts a request against a key's daily quota. If the quota is
+// spent, it says how long until it's renewed.
+func useQuota(hash string, k *apiKey, now time.Time) (bool, time.Duration) {
+	if k.Quota <= 0 {
+		return true, 0
+	}
+
+	now = now.UTC()
+	day := now.Format("2006-01-02")
+
+	keyUsageMtx.Lock()
+	defer keyUsageMtx.Unlock()
+
+	u := keyUsages[hash]
+	if u == nil || u.day != day {
+		// Yesterday's counts are no use to anyone
+		for h, ou := range keyUsages {
+			if ou.day != day {
+				delete(keyUsages, h)
+			}
+		}
+
+		u = &keyUsage{day: day}
+		keyUsages[hash] = u
+	}
+
+	if u.count >= k.Quota {
+		y, m, d := now.Date()
+		return false, time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+	}
+
+	u.count++
+	return true, 0
+}
+
+// withAPIKey makes everything fetched with ctx keep to k's domains.
+func withAPIKey(ctx context.Context, k *apiKey) context.Context {
+	if k == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, apiKeyCtxKey{}, k)
+}
+
+func apiKeyFrom(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(*apiKey)
+	return k
+}
+
+// authorizeKey checks the key a request was made with, known by its hash,
+// if keys are required or one was given, against the hosts it wants feeds
+// from. It returns the key, if any; if the request isn't allowed, the client
+// has already been told why.
+func authorizeKey(w http.ResponseWriter, hash string, hosts []string) (*apiKey, bool) {
+	if hash == "" && !getConfig().RequireKey {
+		return nil, true
+	}
+
+	k := lookupAPIKey(hash)
+	if k == nil {
+		msg := "invalid api key"
+		if hash == "" {
+			msg = errAPIKeyRequired.Error()
+		}
+
+		http.Error(w, msg, http.StatusForbidden)
+		return nil, false
+	}
+
+	for _, h := range hosts {
+		if !k.allowsHost(h) {
+			http.Error(w, fmt.Sprintf("key not allowed to fetch from %s", h), http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return k, true
+}
+
+// chargeKey counts a request against its key's quota, if it has one.
+func chargeKey(w http.ResponseWriter, hash string, k *apiKey) bool {
+	if k == nil {
+		return true
+	}
+
+	ok, wait := useQuota(hash, k, time.Now())
+	if !ok {
+		tooManyRequests(w, wait)
+	}
+
+	return ok
+}
+
+// admitRequest does everything a request has to before it may fetch from
+// hosts: its key is checked, the rate limiter has its say, and only then is
+// the key's quota charged. When it's admitted, the returned context keeps
+// every fetch to the key's domains, and release must be called once the
+// request is done; otherwise, the client has already been told why not.
+func admitRequest(w http.ResponseWriter, req *http.Request, hash string, hosts []string) (ctx context.Context, release func(), ok bool) {
+	k, ok := authorizeKey(w, hash, hosts)
+	if !ok {
+		return
+	}
+
+	release, ok = limitRequest(w, req, hosts)
+	if !ok {
+		return
+	}
+
+	if !chargeKey(w, hash, k) {
+		release()
+		return nil, nil, false
+	}
+
+	return withAPIKey(req.Context(), k), release, true
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, apiKeyBytes)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// cmdKeys manages the keys in the api_keys file. Running servers pick up
+// changes on SIGHUP.
+func cmdKeys(args []string, w io.Writer) error {
+	path := getConfig().APIKeys
+	if path == "" {
+		return fmt.Errorf("keys: %s", errNoAPIKeys)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("keys: missing command\n\n%s", cliUsage)
+	}
+
+	keys, err := readAPIKeys(path)
+	if err != nil {
+		return fmt.Errorf("keys: %s", err)
+	}
+
+	minted := ""
+	switch args[0] {
+	case "list":
+		return listAPIKeys(keys, w)
+	case "mint":
+		minted, err = mintAPIKey(keys, args[1:])
+	case "revoke":
+		err = revokeAPIKey(keys, args[1:])
+	default:
+		return fmt.Errorf("keys: %s: %s\n\n%s", errUnknownCommand, args[0], cliUsage)
+	}
+
+	if err != nil {
+		return fmt.Errorf("keys: %s", err)
+	}
+
+	err = writeAPIKeys(path, keys)
+	if err != nil {
+		return fmt.Errorf("keys: %s", err)
+	}
+
+	// This is the only time anyone gets to see it
+	if minted != "" {
+		fmt.Fprintln(w, minted)
+	}
+
+	return nil
+}
+
+// mintAPIKey adds a new key, returning it.
+func mintAPIKey(keys map[string]*apiKey, args []string) (string, error) {
+	fs := flag.NewFlagSet("keys mint", flag.ContinueOnError)
+	quota := fs.Int("quota", 0, "feed requests a day, 0 for unlimited")
+	domains := fs.String("domains", "", "comma-separated domains feeds may come from")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		return "", errors.New("mint: need a name for the key")
+	}
+
+	if *quota < 0 {
+		return "", fmt.Errorf("mint: invalid quota: %d", *quota)
+	}
+
+	name := fs.Arg(0)
+	for _, k := range keys {
+		if k.Name == name {
+			return "", errDuplicateKey
+		}
+	}
+
+	k := &apiKey{
+		Name:    name,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Quota:   *quota,
+	}
+
+	for _, d := range strings.Split(*domains, ",") {
+		d = strings.TrimSpace(d)
+		if d != "" {
+			k.Domains = append(k.Domains, d)
+		}
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	keys[hashAPIKey(key)] = k
+	return key, nil
+}
+
+// revokeAPIKey removes a key given either by name or the key itself.
+func revokeAPIKey(keys map[string]*apiKey, args []string) error {
+	if len(args) != 1 {
+		return errors.New("revoke: need a key or its name")
+	}
+
+	if _, ok := keys[hashAPIKey(args[0])]; ok {
+		delete(keys, hashAPIKey(args[0]))
+		return nil
+	}
+
+	for h, k := range keys {
+		if k.Name == args[0] {
+			delete(keys, h)
+			return nil
+		}
+	}
+
+	return errUnknownAPIKey
+}
+
+func listAPIKeys(keys map[string]*apiKey, w io.Writer) error {
+	var ks []*apiKey
+	for _, k := range keys {
+		ks = append(ks, k)
+	}
+
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].Name < ks[j].Name
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tQUOTA\tDOMAINS")
+	for _, k := range ks {
+		quota := "-"
+		if k.Quota > 0 {
+			quota = fmt.Sprintf("%d/day", k.Quota)
+		}
+
+		domains := "*"
+		if len(k.Domains) > 0 {
+			domains = strings.Join(k.Domains, ",")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			k.Name,
+			k.Created.Format(time.RFC3339),
+			quota,
+			domains)
+	}
+
+	return tw.Flush()
+}
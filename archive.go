@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// An archivedItem is an extracted article as it appeared in a feed, kept
+// around long after the feed forgets it.
+type archivedItem struct {
+	Feed    string
+	Guid    string
+	Title   string
+	Link    string
+	Content string
+	Author  string
+	PubDate string
+	Seen    time.Time
+
+	Categories []string
+}
+
+const (
+	maxArchiveItems = 200
+)
+
+var (
+	archivePath = ""
+	archive     *bolt.DB
+
+	errNoArchive = errors.New("archive disabled")
+
+	// feed + "\n" + item key -> archivedItem
+	bucketItems = []byte("items")
+
+	// feed -> (sort key -> item key), newest last
+	bucketOrder = []byte("order")
+)
+
+func openArchive(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketItems, bucketOrder} {
+			_, err := tx.CreateBucketIfNotExists(b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	archive = db
+	return nil
+}
+
+func (ai *archivedItem) key() []byte {
+	id := ai.Guid
+	if id == "" {
+		id = ai.Link
+	}
+
+	return []byte(id)
+}
+
+// sortKey orders items by publish date, or by when we first saw them if
+// the feed doesn't say.
+func (ai *archivedItem) sortKey() []byte {
+	t, ok := parseDate(ai.PubDate)
+	if !ok {
+		t = ai.Seen
+	}
+
+	// Flipping the sign bit keeps dates before 1970 sorting before the rest
+	k := make([]byte, 12, 12+len(ai.key()))
+	binary.BigEndian.PutUint64(k, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(k[8:], uint32(t.Nanosecond()))
+
+	return append(k, ai.key()...)
+}
+
+// archiveItems stores a feed's items, keeping the first time each was seen,
+// and forgets the oldest ones past maxArchiveItems. Failures are ignored:
+// the archive is a nicety, not worth failing a feed over.
+func archiveItems(feed string, ais []*archivedItem) {
+	if archive == nil || len(ais) == 0 {
+		return
+	}
+
+	archive.Update(func(tx *bolt.Tx) error {
+		items := tx.Bucket(bucketItems)
+		order, err := tx.Bucket(bucketOrder).CreateBucketIfNotExists([]byte(feed))
+		if err != nil {
+			return err
+		}
+
+		for _, ai := range ais {
+			if len(ai.key()) == 0 {
+				continue
+			}
+
+			ik := append([]byte(feed+"\n"), ai.key()...)
+
+			ai.Seen = time.Now()
+			isNew := true
+			if old := decodeArchivedItem(items.Get(ik)); old != nil {
+				ai.Seen = old.Seen
+				isNew = false
+			}
+
+			var b bytes.Buffer
+			err := gob.NewEncoder(&b).Encode(ai)
+			if err != nil {
+				return err
+			}
+
+			err = items.Put(ik, b.Bytes())
+			if err != nil {
+				return err
+			}
+
+			if isNew {
+				err = order.Put(ai.sortKey(), ai.key())
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return pruneArchive(items, order, feed)
+	})
+}
+
+// pruneArchive drops a feed's oldest items until only maxArchiveItems are
+// left.
+func pruneArchive(items, order *bolt.Bucket, feed string) error {
+	n := 0
+	c := order.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+
+	var old [][]byte
+	for k, _ := c.First(); k != nil && n > maxArchiveItems; k, _ = c.Next() {
+		old = append(old, k)
+		n--
+	}
+
+	// Deleting while iterating makes the cursor skip keys
+	for _, k := range old {
+		err := items.Delete(append([]byte(feed+"\n"), order.Get(k)...))
+		if err != nil {
+			return err
+		}
+
+		err = order.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeArchivedItem(v []byte) *archivedItem {
+	if v == nil {
+		return nil
+	}
+
+	var ai archivedItem
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(&ai)
+	if err != nil {
+		return nil
+	}
+
+	return &ai
+}
+
+// archivedItems gets the newest n items ever seen in a feed.
+func archivedItems(feed string, n int) (ais []*archivedItem, err error) {
+	if archive == nil {
+		return nil, errNoArchive
+	}
+
+	if n > maxArchiveItems {
+		n = maxArchiveItems
+	}
+
+	err = archive.View(func(tx *bolt.Tx) error {
+		order := tx.Bucket(bucketOrder).Bucket([]byte(feed))
+		if order == nil {
+			return nil
+		}
+
+		items := tx.Bucket(bucketItems)
+		c := order.Cursor()
+		for k, v := c.Last(); k != nil && len(ais) < n; k, v = c.Prev() {
+			ik := append([]byte(feed+"\n"), v...)
+			if ai := decodeArchivedItem(items.Get(ik)); ai != nil {
+				ais = append(ais, ai)
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// feedKey identifies a feed in the archive. The credential it's fetched
+// with isn't part of it, but is salted in, just like the article cache's
+// keys: readers with different credentials get different archives.
+func (fr feedRequest) feedKey() string {
+	cred, u := credentialFromURL(fr.baseURL)
+	if cred == nil {
+		cred = lookupCredential(u)
+	}
+
+	if cred == nil {
+		return u.String()
+	}
+
+	return u.String() + "\x00" + cred.cacheSalt()
+}
+
+func (fr feedRequest) rssToArchive(item *RssItem) *archivedItem {
+	author := item.Author
+	if author == "" {
+		author = item.Creator
+	}
+
+	return &archivedItem{
+		Feed:       fr.feedKey(),
+		Guid:       item.Guid,
+		Title:      item.Title,
+		Link:       item.Link,
+		Content:    item.Description,
+		Author:     author,
+		PubDate:    item.PubDate,
+		Categories: item.Categories,
+	}
+}
+
+func (fr feedRequest) atomToArchive(e *AtomEntry) *archivedItem {
+	ai := &archivedItem{
+		Feed:    fr.feedKey(),
+		Guid:    e.Id,
+		Title:   e.Title,
+		PubDate: e.Published,
+	}
+
+	if ai.PubDate == "" {
+		ai.PubDate = e.Updated
+	}
+
+	if e.Link != nil {
+		ai.Link = e.Link.Href
+	}
+
+	if e.Content != nil {
+		ai.Content = e.Content.Content
+	}
+
+	if e.Author != nil {
+		ai.Author = e.Author.Name
+	}
+
+	for _, c := range e.Categories {
+		ai.Categories = append(ai.Categories, c.Term)
+	}
+
+	return ai
+}
+
+func (fr feedRequest) jsonToArchive(item *JSONItem) *archivedItem {
+	ai := &archivedItem{
+		Feed:       fr.feedKey(),
+		Guid:       item.Id,
+		Title:      item.Title,
+		Link:       item.Url,
+		Content:    item.ContentHTML,
+		PubDate:    item.PublishedDate,
+		Categories: item.Tags,
+	}
+
+	if item.Author != nil {
+		ai.Author = item.Author.Name
+	}
+
+	return ai
+}
+
+// archivedRssItems gets the newest items in the archive that the request's
+// filter lets through, just as if they were still in the feed.
+func (fr feedRequest) archivedRssItems() ([]*RssItem, error) {
+	ais, err := archivedItems(fr.feedKey(), fr.archive)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*RssItem, 0, len(ais))
+	for _, ai := range ais {
+		items = append(items, &RssItem{
+			Title:       ai.Title,
+			Link:        ai.Link,
+			Description: ai.Content,
+			Creator:     ai.Author,
+			Guid:        ai.Guid,
+			PubDate:     ai.PubDate,
+			Categories:  ai.Categories,
+		})
+	}
+
+	kept := make([]*RssItem, 0, len(items))
+	for _, item := range fr.filter.rssItems(items) {
+		if !fr.filter.enoughWords(item.Description) {
+			continue
+		}
+
+		fr.t.title = item.Title
+		fr.t.url = item.Link
+		addTracking(&item.Description, fr)
+
+		kept = append(kept, item)
+	}
+
+	return kept, nil
+}
+
+func (fr feedRequest) archivedAtomEntries() ([]*AtomEntry, error) {
+	ais, err := archivedItems(fr.feedKey(), fr.archive)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*AtomEntry, 0, len(ais))
+	for _, ai := range ais {
+		e := &AtomEntry{
+			Title:     ai.Title,
+			Id:        ai.Guid,
+			Updated:   ai.PubDate,
+			Published: ai.PubDate,
+			Link: &AtomLink{
+				Href: ai.Link,
+			},
+			Content: &AtomContent{
+				Type:    "html",
+				Content: ai.Content,
+			},
+		}
+
+		if ai.Author != "" {
+			e.Author = &AtomAuthor{
+				AtomPerson: AtomPerson{
+					Name: ai.Author,
+				},
+			}
+		}
+
+		for _, c := range ai.Categories {
+			e.Categories = append(e.Categories, &AtomCategory{
+				Term: c,
+			})
+		}
+
+		entries = append(entries, e)
+	}
+
+	kept := make([]*AtomEntry, 0, len(entries))
+	for _, e := range fr.filter.atomEntries(entries) {
+		if !fr.filter.enoughWords(e.Content.Content) {
+			continue
+		}
+
+		fr.t.title = e.Title
+		fr.t.url = e.Link.Href
+		addTracking(&e.Content.Content, fr)
+
+		kept = append(kept, e)
+	}
+
+	return kept, nil
+}
+
+func (fr feedRequest) archivedJSONItems() ([]*JSONItem, error) {
+	ais, err := archivedItems(fr.feedKey(), fr.archive)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*JSONItem, 0, len(ais))
+	for _, ai := range ais {
+		item := &JSONItem{
+			Id:            ai.Guid,
+			Url:           ai.Link,
+			Title:         ai.Title,
+			ContentHTML:   ai.Content,
+			PublishedDate: ai.PubDate,
+			Tags:          ai.Categories,
+		}
+
+		if item.Id == "" {
+			item.Id = ai.Link
+		}
+
+		if ai.Author != "" {
+			item.Author = &JSONAuthor{
+				Name: ai.Author,
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	kept := make([]*JSONItem, 0, len(items))
+	for _, item := range fr.filter.jsonItems(items) {
+		if !fr.filter.enoughWords(item.ContentHTML) {
+			continue
+		}
+
+		fr.t.title = item.Title
+		fr.t.url = item.Url
+		addTracking(&item.ContentHTML, fr)
+
+		kept = append(kept, item)
+	}
+
+	return kept, nil
+}
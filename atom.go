@@ -22,6 +22,12 @@ type AtomContent struct {
 	Type    string   `xml:"type,attr"`
 }
 
+type AtomCategory struct {
+	XMLName xml.Name `xml:"category"`
+	Term    string   `xml:"term,attr"`
+	Label   string   `xml:"label,attr,omitempty"`
+}
+
 type AtomAuthor struct {
 	XMLName xml.Name `xml:"author"`
 	AtomPerson
@@ -33,12 +39,12 @@ type AtomContributor struct {
 }
 
 type AtomEntry struct {
-	XMLName     xml.Name `xml:"entry"`
-	Xmlns       string   `xml:"xmlns,attr,omitempty"`
-	Title       string   `xml:"title"`   // required
-	Updated     string   `xml:"updated"` // required
-	Id          string   `xml:"id"`      // required
-	Category    string   `xml:"category,omitempty"`
+	XMLName     xml.Name        `xml:"entry"`
+	Xmlns       string          `xml:"xmlns,attr,omitempty"`
+	Title       string          `xml:"title"`   // required
+	Updated     string          `xml:"updated"` // required
+	Id          string          `xml:"id"`      // required
+	Categories  []*AtomCategory `xml:"category"`
 	Content     *AtomContent
 	Rights      string `xml:"rights,omitempty"`
 	Source      string `xml:"source,omitempty"`
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A credential is whatever a private feed needs to let us in. Any
+// combination of fields may be set.
+type credential struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Cookie   string `json:"cookie,omitempty"`
+}
+
+var credentialsFile = ""
+
+// readCredentials reads a JSON object mapping hosts (with or without port)
+// to credentials.
+func readCredentials(path string) (map[string]*credential, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := map[string]*credential{}
+	err = json.Unmarshal(b, &creds)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := make(map[string]*credential, len(creds))
+	for host, c := range creds {
+		lc[strings.ToLower(host)] = c
+	}
+
+	return lc, nil
+}
+
+// lookupCredential finds the stored credential for a URL's host, preferring
+// an exact host:port match.
+func lookupCredential(u *url.URL) *credential {
+	credentials := getConfig().credentials
+
+	host := strings.ToLower(u.Host)
+	if c, ok := credentials[host]; ok {
+		return c
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return credentials[h]
+	}
+
+	return nil
+}
+
+// credentialFromURL pulls userinfo out of a URL, returning the credential
+// and a copy of the URL without it.
+func credentialFromURL(u *url.URL) (*credential, *url.URL) {
+	if u.User == nil {
+		return nil, u
+	}
+
+	c := &credential{
+		Username: u.User.Username(),
+	}
+	c.Password, _ = u.User.Password()
+
+	cu := *u
+	cu.User = nil
+
+	return c, &cu
+}
+
+func (c *credential) apply(req *http.Request) {
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	if c.Cookie != "" {
+		req.Header.Set("Cookie", c.Cookie)
+	}
+}
+
+// cacheSalt keeps content fetched with credentials from being served to
+// anyone who merely knows the URL.
+func (c *credential) cacheSalt() string {
+	if c == nil {
+		return ""
+	}
+
+	sum := sha1.Sum([]byte(c.Username + "\x00" + c.Password + "\x00" +
+		c.Token + "\x00" + c.Cookie))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
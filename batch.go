@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A batchFeed is what a batch run remembers about a feed it converted.
+type batchFeed struct {
+	File    string
+	Source  string
+	Updated time.Time
+}
+
+const (
+	batchStateFile = ".ohmyrss-batch.json"
+	batchIndexFile = "index.opml"
+
+	maxBatchNameLen = 60
+)
+
+var (
+	batchNameChars = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+)
+
+// cmdBatch converts every feed of an OPML file into a directory that can be
+// served as-is, along with an OPML index of the results. Feeds whose source
+// hasn't changed since the last run are left alone.
+func cmdBatch(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	opts := fs.String("q", "", "feed options, as a query string")
+	base := fs.String("base", "", "URL the output directory is served from")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("batch: expected an OPML file and an output directory\n\n%s", cliUsage)
+	}
+
+	form, err := url.ParseQuery(*opts)
+	if err != nil {
+		return fmt.Errorf("batch: invalid options: %s", err)
+	}
+
+	baseURL, err := url.Parse(*base)
+	if err != nil {
+		return fmt.Errorf("batch: invalid base: %s", err)
+	}
+
+	req := &http.Request{
+		Form: form,
+	}
+
+	opml, err := readOpml(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	}
+
+	dir := fs.Arg(1)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	}
+
+	state := loadBatchState(dir)
+	index := &Opml{
+		Version: "2.0",
+		Head: &OpmlHead{
+			Title:       "OhMyRSS",
+			DateCreated: time.Now().Format(time.RFC1123Z),
+		},
+		Body: &OpmlBody{},
+	}
+
+	if opml.Head != nil && opml.Head.Title != "" {
+		index.Head.Title = "OhMyRSS: " + opml.Head.Title
+	}
+
+	feeds := opml.feeds()
+	failed := 0
+	for _, ol := range feeds {
+		bf, err := batchConvert(ol.XmlUrl, req, *opts, dir, state[ol.XmlUrl])
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(w, "failed %s: %s\n", ol.XmlUrl, err)
+		case bf == state[ol.XmlUrl]:
+			fmt.Fprintf(w, "unchanged %s\n", ol.XmlUrl)
+		default:
+			fmt.Fprintf(w, "updated %s -> %s\n", ol.XmlUrl, bf.File)
+			state[ol.XmlUrl] = bf
+		}
+
+		// A feed that failed this time still has whatever was written last
+		// time
+		bf = state[ol.XmlUrl]
+		if bf == nil {
+			continue
+		}
+
+		title := ol.Title
+		if title == "" {
+			title = ol.Text
+		}
+
+		index.Body.Outlines = append(index.Body.Outlines, &OpmlOutline{
+			Text:    ol.Text,
+			Title:   title,
+			Type:    "rss",
+			XmlUrl:  batchFileURL(baseURL, bf.File),
+			HtmlUrl: ol.HtmlUrl,
+		})
+	}
+
+	out, err := xml.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, batchIndexFile), append([]byte(xml.Header), out...))
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	}
+
+	err = saveBatchState(dir, state)
+	if err != nil {
+		return fmt.Errorf("batch: %s", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("batch: %d of %d feeds failed", failed, len(feeds))
+	}
+
+	return nil
+}
+
+// batchConvert converts a single feed, returning prev untouched if its
+// source hasn't changed since last time. Only then are any articles
+// fetched.
+func batchConvert(
+	feedURL string,
+	req *http.Request,
+	opts string,
+	dir string,
+	prev *batchFeed) (*batchFeed, error) {
+
+	u, err := parseFeedURL(feedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	fr, err := parseFeedRequest(req, u)
+	if err != nil {
+		return nil, err
+	}
+
+	fr.t.disabled = true
+	ctx := context.Background()
+
+	raw, err := fetchFeedBody(ctx, fr.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	f, redirectURL, err := decodeFeed(ctx, fr, raw)
+	if err == nil && redirectURL != "" {
+		// A page pointing at its feed: it's the feed that changes
+		fr.baseURL, err = url.Parse(redirectURL)
+		if err == nil {
+			raw, err = fetchFeedBody(ctx, fr.baseURL)
+		}
+
+		if err == nil {
+			f, _, err = decodeFeed(ctx, fr, raw)
+		}
+	}
+
+	if err != nil {
+		return nil, cliFeedError(err)
+	}
+
+	source := batchSourceSum(raw, opts)
+	if prev != nil && prev.Source == source {
+		_, err := os.Stat(filepath.Join(dir, prev.File))
+		if err == nil {
+			return prev, nil
+		}
+	}
+
+	feed, err := encodeFeed(ctx, f, fr)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := &batchFeed{
+		File:    batchFileName(u, feed),
+		Source:  source,
+		Updated: time.Now(),
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, bf.File), []byte(feed))
+	if err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// batchSourceSum identifies a version of a feed, as served, converted with
+// some options.
+func batchSourceSum(raw []byte, opts string) string {
+	h := sha1.New()
+	io.WriteString(h, opts+"\n")
+	h.Write(raw)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// batchFileURL is where a converted feed will be found, under the URL the
+// output directory is served from. Without one, it's relative to the index.
+func batchFileURL(base *url.URL, file string) string {
+	ref := &url.URL{Path: file}
+	if *base == (url.URL{}) {
+		return ref.String()
+	}
+
+	// The base is a directory, whether or not it says so
+	b := *base
+	if !strings.HasSuffix(b.Path, "/") {
+		b.Path += "/"
+		b.RawPath = ""
+	}
+
+	return b.ResolveReference(ref).String()
+}
+
+// batchFileName gives a feed a name that's readable and won't collide with
+// any other feed's.
+func batchFileName(u *url.URL, feed string) string {
+	name := strings.Trim(batchNameChars.ReplaceAllString(u.Host+u.Path, "-"), "-")
+	if len(name) > maxBatchNameLen {
+		name = name[:maxBatchNameLen]
+	}
+
+	ext := ".xml"
+	if strings.HasPrefix(feedContentType(feed), "application/feed+json") {
+		ext = ".json"
+	}
+
+	sum := sha1.Sum([]byte(u.String()))
+	return fmt.Sprintf("%s-%x%s", name, sum[:4], ext)
+}
+
+func readOpml(path string) (*Opml, error) {
+	u, err := cliFeedURL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := openFeed(withLocalFile(context.Background(), u), u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	opml := &Opml{}
+	err = xml.NewDecoder(body).Decode(opml)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPML: %s", err)
+	}
+
+	return opml, nil
+}
+
+func loadBatchState(dir string) map[string]*batchFeed {
+	state := map[string]*batchFeed{}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, batchStateFile))
+	if err == nil {
+		// A broken state file just means converting everything again
+		json.Unmarshal(b, &state)
+	}
+
+	return state
+}
+
+func saveBatchState(dir string, state map[string]*batchFeed) error {
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, batchStateFile), b)
+}
+
+// writeFileAtomic makes sure nobody serving the directory ever sees half a
+// file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
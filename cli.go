@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type localFilesKey struct{}
+
+var (
+	errUnsupportedScheme = errors.New("only http and https URLs can be fetched")
+	errUnknownCommand    = errors.New("unknown command")
+	errNoArticle         = errors.New("could not extract article")
+
+	cliUsage = `usage:
+	ohmyrss [flags]                             run the server
+	ohmyrss [flags] convert [-q opts] <url|file>...
+	                                            write a full-text feed to stdout
+	ohmyrss [flags] extract <url>               write an extracted article to stdout
+	ohmyrss [flags] batch [-q opts] [-base url] <opml> <dir>
+	                                            convert every feed in an OPML file into dir
+	ohmyrss [flags] keys mint [-quota n] [-domains a,b] <name>
+	                                            create an API key and print it
+	ohmyrss [flags] keys revoke <name|key>      revoke an API key
+	ohmyrss [flags] keys list                   list API keys
+
+-q takes the same options as the server's query string, like
+"max=5&include=golang". Giving convert several feeds merges them. batch
+writes an index.opml linking to its feeds at -base, and only converts feeds
+that changed since the last run.
+
+API keys live in the -keys file, and are given to the server as
+/k/<key>/?url=... or ?key=<key>. Running servers pick up changes on SIGHUP.`
+)
+
+// runCommand runs a subcommand given on the command line instead of
+// starting a server.
+func runCommand(args []string, w io.Writer) error {
+	switch args[0] {
+	case "convert":
+		return cmdConvert(args[1:], w)
+	case "extract":
+		return cmdExtract(args[1:], w)
+	case "batch":
+		return cmdBatch(args[1:], w)
+	case "keys":
+		return cmdKeys(args[1:], w)
+	}
+
+	return fmt.Errorf("%s: %s\n\n%s", errUnknownCommand, args[0], cliUsage)
+}
+
+func cmdConvert(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	opts := fs.String("q", "", "feed options, as a query string")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("convert: missing feed\n\n%s", cliUsage)
+	}
+
+	form, err := url.ParseQuery(*opts)
+	if err != nil {
+		return fmt.Errorf("convert: invalid options: %s", err)
+	}
+
+	req := &http.Request{
+		Form: form,
+	}
+
+	ctx := context.Background()
+
+	var frs []feedRequest
+	for _, arg := range fs.Args() {
+		u, err := cliFeedURL(arg)
+		if err != nil {
+			return fmt.Errorf("convert: invalid feed %s: %s", arg, err)
+		}
+
+		if u.Scheme == "file" {
+			ctx = withLocalFile(ctx, u)
+		}
+
+		fr, err := parseFeedRequest(req, u)
+		if err != nil {
+			return fmt.Errorf("convert: %s", err)
+		}
+
+		fr.t.disabled = true
+		frs = append(frs, fr)
+	}
+
+	var feed string
+	if len(frs) > 1 {
+		feed, err = handleMerged(ctx, frs, "")
+	} else {
+		feed, err = cliHandleFeed(ctx, frs[0])
+	}
+
+	if err != nil {
+		return fmt.Errorf("convert: %s", err)
+	}
+
+	_, err = fmt.Fprintln(w, feed)
+	return err
+}
+
+// cliHandleFeed is handleFeed, following a landing page to its feed since
+// there's nobody to redirect.
+func cliHandleFeed(ctx context.Context, fr feedRequest) (string, error) {
+	feed, redirectURL, err := handleFeed(ctx, fr)
+	if redirectURL != "" {
+		fr.baseURL, err = url.Parse(redirectURL)
+		if err != nil {
+			return "", err
+		}
+
+		feed, _, err = handleFeed(ctx, fr)
+	}
+
+	if err != nil {
+		return "", cliFeedError(err)
+	}
+
+	return feed, nil
+}
+
+// cliFeedError spells out the feeds there are to pick from when a page has
+// more than one.
+func cliFeedError(err error) error {
+	mf, ok := err.(*multipleFeedsError)
+	if !ok {
+		return err
+	}
+
+	var urls []string
+	for _, f := range mf.feeds {
+		urls = append(urls, f.URL)
+	}
+
+	return fmt.Errorf("%s, pick one of:\n\t%s",
+		err,
+		strings.Join(urls, "\n\t"))
+}
+
+// cliFeedURL reads a feed argument, which may be a local file.
+func cliFeedURL(arg string) (*url.URL, error) {
+	if _, err := os.Stat(arg); err == nil {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &url.URL{
+			Scheme: "file",
+			Path:   filepath.ToSlash(path),
+		}, nil
+	}
+
+	return parseFeedURL(arg)
+}
+
+// withLocalFile lets a file named on the command line be read as a feed.
+// Nothing else gets to: not the server, and not a landing page that links to
+// file:///etc/passwd.
+func withLocalFile(ctx context.Context, u *url.URL) context.Context {
+	files := map[string]bool{u.String(): true}
+
+	prev, _ := ctx.Value(localFilesKey{}).(map[string]bool)
+	for f := range prev {
+		files[f] = true
+	}
+
+	return context.WithValue(ctx, localFilesKey{}, files)
+}
+
+// openFeed gets a feed's content over http(s), or from a file that
+// withLocalFile allowed.
+func openFeed(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	switch u.Scheme {
+	case "http", "https":
+		return httpGetURL(ctx, u, nil)
+
+	case "file":
+		files, _ := ctx.Value(localFilesKey{}).(map[string]bool)
+		if !files[u.String()] {
+			break
+		}
+
+		f, err := os.Open(filepath.FromSlash(u.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		return http.MaxBytesReader(nil, f, getConfig().MaxResponseBytes), nil
+	}
+
+	return nil, errUnsupportedScheme
+}
+
+func cmdExtract(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("extract: expected a single url\n\n%s", cliUsage)
+	}
+
+	u, err := parseFeedURL(args[0])
+	if err != nil {
+		return fmt.Errorf("extract: invalid url: %s", err)
+	}
+
+	a := getArticle(context.Background(), u.String(), nil)
+	if a == nil {
+		return fmt.Errorf("extract: %s", errNoArticle)
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n%s\n\n%s\n", a.Title, a.FinalURL, a.Content)
+	return err
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A config is everything that can be tuned. Values come from defaults, then
+// the config file, then any flags given on the command line.
+type config struct {
+	serverConfig
+
+	Credentials string `toml:"credentials"`
+	Bundles     string `toml:"bundles"`
+
+	// API keys, managed with the keys command; with require_key, feeds are
+	// only served to requests carrying one
+	APIKeys    string `toml:"api_keys"`
+	RequireKey bool   `toml:"require_key"`
+
+	// Signs /f/<token> URLs; changing it breaks every one handed out. With
+	// signed_only, feeds are only served through them, and only API keys
+	// get to mint them.
+	TokenSecret string `toml:"token_secret"`
+	SignedOnly  bool   `toml:"signed_only"`
+
+	MaxResponseBytes int64    `toml:"max_response_bytes"`
+	HTTPTimeout      duration `toml:"http_timeout"`
+	ArticleTTL       duration `toml:"article_ttl"`
+	FailedArticleTTL duration `toml:"failed_article_ttl"`
+
+	// Where feeds without an icon get one from; %s is the feed's host
+	Favicon string `toml:"favicon"`
+
+	// Requests a minute each client, and each host we're asked to fetch
+	// from, gets, in bursts of up to so many; a rate of 0 is unlimited
+	IPRate    float64 `toml:"ip_rate"`
+	IPBurst   int     `toml:"ip_burst"`
+	HostRate  float64 `toml:"host_rate"`
+	HostBurst int     `toml:"host_burst"`
+
+	// Addresses or CIDRs of proxies whose X-Forwarded-For is believed
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// The one header trusted proxies say who they forwarded for in:
+	// X-Forwarded-For, Forwarded or X-Real-IP
+	ProxyHeader string `toml:"proxy_header"`
+
+	// Looked up by /readyz to check DNS works; empty, the default, looks up
+	// the favicon service
+	ReadyDNSHost string `toml:"ready_dns_host"`
+
+	// debug, info, warn or error
+	LogLevel string `toml:"log_level"`
+
+	// Share of feed and API requests that went well that get logged, from 0 to 1
+	LogSample float64 `toml:"log_sample"`
+
+	// Which hosts feeds, and the articles they link to, may be fetched from
+	FeedHosts    hostPatterns `toml:"feed_hosts"`
+	ArticleHosts hostPatterns `toml:"article_hosts"`
+
+	client      *http.Client
+	trustedNets []*net.IPNet
+
+	// What the files above hold, as of when the config was loaded
+	credentials map[string]*credential
+	bundles     map[string]*bundle
+	apiKeys     map[string]*apiKey
+}
+
+// serverConfig is the part of a config that only takes effect on restart.
+type serverConfig struct {
+	Fcgi            bool     `toml:"fcgi"`
+	HTTPPort        int      `toml:"http_port"`
+	MemcacheServers []string `toml:"memcache_servers"`
+	Archive         string   `toml:"archive"`
+	Index           string   `toml:"index"`
+	Debug           bool     `toml:"debug"`
+
+	// host:port, or unix:/path/to/socket; :http_port if empty
+	Listen string `toml:"listen"`
+
+	// Certificates are reloaded whenever the files change
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// Zero means no timeout
+	ReadTimeout       duration `toml:"read_timeout"`
+	ReadHeaderTimeout duration `toml:"read_header_timeout"`
+	WriteTimeout      duration `toml:"write_timeout"`
+	IdleTimeout       duration `toml:"idle_timeout"`
+
+	// How long in-flight requests get to finish on SIGTERM before their
+	// extractions are cancelled
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	// Feed requests handled at once; 0 is unlimited
+	MaxConcurrent int `toml:"max_concurrent"`
+}
+
+// hostPatterns decide which hosts may be fetched from. Patterns are globs,
+// like "*.example.com"; deny wins, and an empty allow list allows anything.
+type hostPatterns struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// A duration is a time.Duration written like "10s" or "168h".
+type duration struct {
+	time.Duration
+}
+
+const (
+	// memcache reads anything longer as a unix timestamp
+	maxCacheTTL = 30 * 24 * time.Hour
+)
+
+var (
+	configFile = ""
+
+	configMtx sync.RWMutex
+	conf      = newConfig()
+
+	// Why the last reload failed, if it did
+	reloadErr error
+)
+
+func init() {
+	flag.StringVar(&configFile, "config", "", "TOML config file, reloaded on SIGHUP; flags override it")
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+func newConfig() *config {
+	c := &config{
+		serverConfig: serverConfig{
+			HTTPPort:          8080,
+			ReadTimeout:       duration{30 * time.Second},
+			ReadHeaderTimeout: duration{10 * time.Second},
+			WriteTimeout:      duration{5 * time.Minute},
+			IdleTimeout:       duration{2 * time.Minute},
+			ShutdownTimeout:   duration{30 * time.Second},
+			MaxConcurrent:     64,
+		},
+		MaxResponseBytes: 4 * 1024 * 1024,
+		HTTPTimeout:      duration{10 * time.Second},
+		ArticleTTL:       duration{7 * 24 * time.Hour},
+		FailedArticleTTL: duration{3 * time.Minute},
+		Favicon:          "https://www.google.com/s2/favicons?domain=%s&alt=feed",
+		IPRate:           60,
+		IPBurst:          30,
+		HostRate:         120,
+		HostBurst:        60,
+		TrustedProxies:   []string{"127.0.0.0/8", "::1"},
+		ProxyHeader:      "X-Forwarded-For",
+		LogLevel:         "info",
+		LogSample:        1,
+	}
+
+	c.init()
+	return c
+}
+
+func (c *config) init() {
+	c.client = &http.Client{
+		Timeout:   c.HTTPTimeout.Duration,
+		Transport: fetchTransport{},
+	}
+
+	// Already validated
+	c.trustedNets, _ = parseCIDRs(c.TrustedProxies)
+}
+
+// readConfig builds a config from the config file, if any, and the flags.
+func readConfig(path string) (*config, error) {
+	c := newConfig()
+
+	if path != "" {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if und := md.Undecoded(); len(und) > 0 {
+			return nil, fmt.Errorf("unknown setting: %s", und[0])
+		}
+	}
+
+	flag.Visit(c.setFlag)
+
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	c.init()
+	return c, nil
+}
+
+// setFlag copies a flag given on the command line over the config file.
+func (c *config) setFlag(f *flag.Flag) {
+	switch f.Name {
+	case "fcgi":
+		c.Fcgi = runFcgi
+	case "httpPort":
+		c.HTTPPort = httpPort
+	case "mcServers":
+		c.MemcacheServers = nil
+		if memcacheServers != "" {
+			c.MemcacheServers = strings.Split(memcacheServers, ",")
+		}
+	case "credentials":
+		c.Credentials = credentialsFile
+	case "bundles":
+		c.Bundles = bundlesFile
+	case "keys":
+		c.APIKeys = apiKeysFile
+	case "requireKey":
+		c.RequireKey = requireKey
+	case "archive":
+		c.Archive = archivePath
+	case "index":
+		c.Index = indexPath
+	case "debug":
+		c.Debug = debugEnabled
+	}
+}
+
+func (c *config) validate() error {
+	if !c.Fcgi && c.Listen == "" && (c.HTTPPort <= 0 || c.HTTPPort > 65535) {
+		return fmt.Errorf("invalid http_port: %d", c.HTTPPort)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key go together")
+	}
+
+	timeouts := []struct {
+		name string
+		d    duration
+	}{
+		{"read_timeout", c.ReadTimeout},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	}
+
+	for _, t := range timeouts {
+		if t.d.Duration < 0 {
+			return fmt.Errorf("invalid %s: %s", t.name, t.d)
+		}
+	}
+
+	if c.MaxResponseBytes <= 0 {
+		return fmt.Errorf("invalid max_response_bytes: %d", c.MaxResponseBytes)
+	}
+
+	if c.HTTPTimeout.Duration <= 0 {
+		return fmt.Errorf("invalid http_timeout: %s", c.HTTPTimeout)
+	}
+
+	ttls := []struct {
+		name string
+		d    duration
+	}{
+		{"article_ttl", c.ArticleTTL},
+		{"failed_article_ttl", c.FailedArticleTTL},
+	}
+
+	for _, ttl := range ttls {
+		if ttl.d.Duration < time.Second || ttl.d.Duration > maxCacheTTL {
+			return fmt.Errorf("invalid %s: %s, must be between 1s and %s",
+				ttl.name,
+				ttl.d,
+				maxCacheTTL)
+		}
+	}
+
+	fav := fmt.Sprintf(c.Favicon, "example.com")
+	if !strings.Contains(fav, "example.com") || strings.Contains(fav, "%!") {
+		return errors.New("invalid favicon: must contain a single %s for the host")
+	}
+
+	if c.RequireKey && c.APIKeys == "" {
+		return fmt.Errorf("invalid require_key: %s", errNoAPIKeys)
+	}
+
+	if c.TokenSecret != "" && len(c.TokenSecret) < minTokenSecret {
+		return fmt.Errorf("invalid token_secret: must be at least %d characters", minTokenSecret)
+	}
+
+	if c.SignedOnly && c.TokenSecret == "" {
+		return fmt.Errorf("invalid signed_only: %s", errNoTokenSecret)
+	}
+
+	if c.SignedOnly && c.APIKeys == "" {
+		return fmt.Errorf("invalid signed_only: %s", errNoAPIKeys)
+	}
+
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("invalid max_concurrent: %d", c.MaxConcurrent)
+	}
+
+	if c.IPRate < 0 || c.IPBurst < 0 || c.HostRate < 0 || c.HostBurst < 0 {
+		return errors.New("rates and bursts can't be negative")
+	}
+
+	_, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %s", err)
+	}
+
+	if !proxyHeaders[c.ProxyHeader] {
+		return fmt.Errorf("invalid proxy_header: %q", c.ProxyHeader)
+	}
+
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("invalid log_level: %q", c.LogLevel)
+	}
+
+	if c.LogSample < 0 || c.LogSample > 1 {
+		return fmt.Errorf("invalid log_sample: %g, must be between 0 and 1", c.LogSample)
+	}
+
+	hps := []struct {
+		name string
+		hp   hostPatterns
+	}{
+		{"feed_hosts", c.FeedHosts},
+		{"article_hosts", c.ArticleHosts},
+	}
+
+	for _, hp := range hps {
+		err = hp.hp.validate()
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", hp.name, err)
+		}
+	}
+
+	for _, s := range c.MemcacheServers {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("invalid memcache_servers: empty server")
+		}
+	}
+
+	return nil
+}
+
+func getConfig() *config {
+	configMtx.RLock()
+	defer configMtx.RUnlock()
+
+	return conf
+}
+
+func setConfig(c *config) {
+	configMtx.Lock()
+	conf = c
+	configMtx.Unlock()
+}
+
+func (hp hostPatterns) validate() error {
+	for _, p := range append(hp.Allow, hp.Deny...) {
+		_, err := path.Match(p, "")
+		if err != nil || p == "" {
+			return fmt.Errorf("bad pattern: %q", p)
+		}
+	}
+
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows checks a URL's host, ignoring any port, against the patterns.
+func (hp hostPatterns) allows(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+
+	if matchHost(hp.Deny, host) {
+		return false
+	}
+
+	return len(hp.Allow) == 0 || matchHost(hp.Allow, host)
+}
+
+func faviconURL(host string) string {
+	return fmt.Sprintf(getConfig().Favicon, host)
+}
+
+// loadConfigFiles loads the files a config points at into it. Nothing takes
+// effect until the config is set, so a failure leaves everything as it was.
+func loadConfigFiles(c *config) (err error) {
+	if c.Credentials != "" {
+		c.credentials, err = readCredentials(c.Credentials)
+		if err != nil {
+			return fmt.Errorf("failed to load credentials: %s", err)
+		}
+	}
+
+	if c.Bundles != "" {
+		c.bundles, err = readBundles(c.Bundles)
+		if err != nil {
+			return fmt.Errorf("failed to load bundles: %s", err)
+		}
+	}
+
+	if c.APIKeys != "" {
+		c.apiKeys, err = readAPIKeys(c.APIKeys)
+		if err != nil {
+			return fmt.Errorf("failed to load api keys: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// lastReloadError says why the last reload failed, if it did.
+func lastReloadError() error {
+	configMtx.RLock()
+	defer configMtx.RUnlock()
+
+	return reloadErr
+}
+
+// reloadConfig rereads the config. The serverConfig stays put until a
+// restart.
+func reloadConfig() (err error) {
+	defer func() {
+		configMtx.Lock()
+		reloadErr = err
+		configMtx.Unlock()
+	}()
+
+	c, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	err = loadConfigFiles(c)
+	if err != nil {
+		return err
+	}
+
+	old := getConfig()
+	if !reflect.DeepEqual(c.serverConfig, old.serverConfig) {
+		logEvent(logWarn, "config: server settings changed, they need a restart", nil)
+		c.serverConfig = old.serverConfig
+	}
+
+	setConfig(c)
+	return nil
+}
+
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			err := reloadConfig()
+			if err != nil {
+				logEvent(logError, "config: reload failed, keeping the old one", map[string]interface{}{
+					"error": err.Error(),
+				})
+				continue
+			}
+
+			logEvent(logInfo, "config: reloaded", nil)
+		}
+	}()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Layouts tried, in order, when a feed or page gives us a date. Dates are
+// normalized first (see normalizeDate), so these only need to cover the
+// shapes left after that.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+
+	// RFC822 and friends, with and without the day of the week, seconds,
+	// and with 2 or 4 digit years
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"Mon, 2 Jan 2006",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006",
+	"Mon, Jan 2 15:04:05 2006",
+	"Mon, Jan 2 15:04:05 -0700 2006",
+	"January 2, 2006 15:04:05",
+	"January 2, 2006",
+	"Mon, January 2, 2006",
+	"Jan 2, 2006",
+
+	// Zones we don't know: better a few hours off than no date at all
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 MST",
+	"2006-01-02 15:04:05 MST",
+}
+
+var (
+	// RFC822 only defines a few zones; Go doesn't know their offsets unless
+	// they happen to be local
+	dateZones = map[string]string{
+		"UT":  "+0000",
+		"UTC": "+0000",
+		"GMT": "+0000",
+		"Z":   "+0000",
+		"EST": "-0500",
+		"EDT": "-0400",
+		"CST": "-0600",
+		"CDT": "-0500",
+		"MST": "-0700",
+		"MDT": "-0600",
+		"PST": "-0800",
+		"PDT": "-0700",
+	}
+
+	dateComment   = regexp.MustCompile(`\s*\([^)]*\)\s*$`)
+	dateColonZone = regexp.MustCompile(` ([+-]\d\d):(\d\d)$`)
+	dateDayName   = regexp.MustCompile(`^(?i)(mon|tue|wed|thu|fri|sat|sun)[a-z]*,?\s+`)
+	dateOrdinal   = regexp.MustCompile(`(\d)(st|nd|rd|th)\b`)
+)
+
+// normalizeDate irons out the variations seen in the wild that no layout
+// can handle: stray whitespace, full day names, trailing "(PST)" comments,
+// "+01:00" offsets on RFC822 dates, named zones and English ordinals.
+func normalizeDate(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	s = dateComment.ReplaceAllString(s, "")
+
+	if m := dateDayName.FindStringSubmatch(s); m != nil {
+		day := strings.ToUpper(m[1][:1]) + strings.ToLower(m[1][1:])
+		s = day + ", " + s[len(m[0]):]
+	}
+
+	s = dateOrdinal.ReplaceAllString(s, "$1")
+	s = dateColonZone.ReplaceAllString(s, " $1$2")
+
+	if i := strings.LastIndex(s, " "); i >= 0 {
+		if off, ok := dateZones[strings.ToUpper(s[i+1:])]; ok {
+			s = s[:i+1] + off
+		}
+	}
+
+	return s
+}
+
+// parseDate makes a best effort at reading a date written by someone else.
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+
+	s = normalizeDate(s)
+	for _, l := range dateLayouts {
+		t, err := time.Parse(l, s)
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// rssDate normalizes a date for an RSS feed, passing along anything
+// unparseable untouched.
+func rssDate(d string) string {
+	t, ok := parseDate(d)
+	if !ok {
+		return d
+	}
+
+	return t.Format(time.RFC1123Z)
+}
+
+func rssItemDate(item *RssItem) time.Time {
+	t, _ := parseDate(item.PubDate)
+	return t
+}
+
+func atomEntryDate(e *AtomEntry) time.Time {
+	t, ok := parseDate(e.Updated)
+	if !ok {
+		t, _ = parseDate(e.Published)
+	}
+
+	return t
+}
+
+func jsonItemDate(item *JSONItem) time.Time {
+	t, ok := parseDate(item.PublishedDate)
+	if !ok {
+		t, _ = parseDate(item.ModifiedDate)
+	}
+
+	return t
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/thatguystone/swan"
+)
+
+// An extractCandidate is a node that might have held the article. swan
+// doesn't say how it scored things, so Estimate is only an approximation of
+// the way it goes about it: the text in the paragraphs below a node, less
+// whatever of that text is links. It can rank nodes differently than swan.
+type extractCandidate struct {
+	Path        string
+	Words       int
+	LinkDensity float64
+	Estimate    float64
+	Chosen      bool
+	Text        string
+
+	sel *goquery.Selection
+}
+
+type extractStage struct {
+	Name string
+	Took time.Duration
+}
+
+type extractDebug struct {
+	URL         string
+	FinalURL    string
+	Credential  bool
+	CacheKey    string
+	CacheStatus string
+	Status      string
+	Title       string
+	TopNode     string
+	TopNodePath string
+	HTML        string
+	Candidates  []*extractCandidate
+	Stages      []extractStage
+}
+
+const (
+	maxDebugCandidates = 15
+	minCandidateWords  = 5
+)
+
+var (
+	debugEnabled = false
+
+	debugPage = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<head>
+	<title>OhMyRSS: debug {{ .URL }}</title>
+	<meta http-equiv="content-type" content="text/html; charset=utf-8"/>
+	<style>
+	pre {
+		background: #ededed;
+		max-height: 400px;
+		overflow: auto;
+		white-space: pre-wrap;
+	}
+
+	.chosen {
+		font-weight: bold;
+	}
+	</style>
+</head>
+<body>
+	<form action="" method="get">
+		<input name="url" type="text" size="80" value="{{ .URL }}" autofocus />
+		<input type="submit" value="Extract" />
+	</form>
+	<table>
+		<tr><th>URL</th><td>{{ .URL }}</td></tr>
+		<tr><th>Final URL</th><td>{{ .FinalURL }}</td></tr>
+		<tr><th>Title</th><td>{{ .Title }}</td></tr>
+		<tr><th>Credentials</th><td>{{ if .Credential }}yes{{ else }}no{{ end }}</td></tr>
+		<tr><th>Cache key</th><td>{{ .CacheKey }}</td></tr>
+		<tr><th>Cache</th><td>{{ .CacheStatus }}</td></tr>
+		<tr><th>Status</th><td>{{ .Status }}</td></tr>
+	</table>
+	<h2>Timing</h2>
+	<table>
+		{{ range .Stages }}<tr><th>{{ .Name }}</th><td>{{ .Took }}</td></tr>
+		{{ end }}
+	</table>
+	<h2>Candidates</h2>
+	<p>
+		swan doesn't expose its scores: these are estimated here, roughly the
+		way it goes about it, and can rank nodes differently. Its pick is in
+		bold.
+	</p>
+	<table>
+		<tr><th>Estimated score</th><th>Words</th><th>Links</th><th>Node</th><th>Text</th></tr>
+		{{ range .Candidates }}<tr{{ if .Chosen }} class="chosen"{{ end }}>
+			<td>{{ printf "%.1f" .Estimate }}</td>
+			<td>{{ .Words }}</td>
+			<td>{{ printf "%.2f" .LinkDensity }}</td>
+			<td>{{ .Path }}</td>
+			<td>{{ .Text }}</td>
+		</tr>
+		{{ end }}
+	</table>
+	<h2>Top node: {{ .TopNodePath }}</h2>
+	<pre>{{ .TopNode }}</pre>
+	<h2>Fetched HTML</h2>
+	<pre>{{ .HTML }}</pre>
+</body>`))
+)
+
+// debugExtractHandler walks through extracting an article the way
+// getArticle would, showing its work. It's let in like any other request,
+// and never at all when only signed URLs are served.
+func debugExtractHandler(w http.ResponseWriter, req *http.Request) {
+	if getConfig().SignedOnly {
+		http.Error(w, errUnsigned.Error(), http.StatusForbidden)
+		return
+	}
+
+	link := strings.TrimSpace(req.FormValue("url"))
+
+	d := &extractDebug{
+		URL: link,
+	}
+
+	if link != "" {
+		u, err := parseFeedURL(link)
+		if err != nil || u.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+
+		ctx, release, ok := admitRequest(w, req, requestKeyHash(req), []string{u.Host})
+		if !ok {
+			return
+		}
+		defer release()
+
+		debugExtract(ctx, d, u)
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	debugPage.Execute(w, d)
+}
+
+func debugExtract(ctx context.Context, d *extractDebug, u *url.URL) {
+	stage := func(name string, start time.Time) {
+		d.Stages = append(d.Stages, extractStage{
+			Name: name,
+			Took: time.Since(start),
+		})
+	}
+
+	// Only credentials given with the URL: this page shows whatever comes
+	// back, and stored ones aren't the asker's to use
+	cred, u := credentialFromURL(u)
+
+	d.Credential = cred != nil
+	d.CacheKey = articleCacheKey(u, cred)
+
+	start := time.Now()
+	_, err := hitCache(d.CacheKey)
+	stage("cache", start)
+
+	switch err {
+	case nil:
+		d.CacheStatus = "hit"
+	case memcache.ErrCacheMiss:
+		d.CacheStatus = "miss"
+	default:
+		d.CacheStatus = err.Error()
+	}
+
+	start = time.Now()
+	finalURL, html, err := fetchArticleHTML(ctx, u, cred)
+	stage("fetch", start)
+
+	if err != nil {
+		d.Status = err.Error()
+		return
+	}
+
+	d.FinalURL = finalURL
+	d.HTML = string(html)
+
+	start = time.Now()
+	sa, err := swan.FromHTML(finalURL, html)
+	stage("extract", start)
+
+	switch {
+	case err != nil:
+		d.Status = err.Error()
+	case sa == nil || sa.TopNode == nil:
+		d.Status = "no content found"
+	default:
+		d.Status = "ok"
+	}
+
+	if sa == nil {
+		return
+	}
+
+	start = time.Now()
+	d.Title = pageTitle(html)
+	stage("title", start)
+
+	if sa.TopNode != nil && sa.TopNode.Length() > 0 {
+		d.TopNode, _ = sa.TopNode.Html()
+		d.TopNodePath = nodeSignature(sa.TopNode)
+	}
+
+	if sa.Doc != nil {
+		start = time.Now()
+		d.Candidates = estimateCandidates(sa.Doc, sa.TopNode)
+		stage("score", start)
+	}
+}
+
+// estimateCandidates finds the nodes most likely to be the article: every
+// paragraph counts fully for its parent and half for its grandparent.
+func estimateCandidates(doc *goquery.Document, top *goquery.Selection) []*extractCandidate {
+	// Selections aren't comparable, the nodes they wrap are
+	byNode := map[interface{}]*extractCandidate{}
+
+	add := func(s *goquery.Selection, estimate float64) {
+		if s.Length() == 0 {
+			return
+		}
+
+		c := byNode[s.Get(0)]
+		if c == nil {
+			c = &extractCandidate{
+				Path: nodeSignature(s),
+				sel:  s,
+			}
+			byNode[s.Get(0)] = c
+		}
+
+		c.Estimate += estimate
+	}
+
+	doc.Find("p, pre, td").Each(func(i int, s *goquery.Selection) {
+		words := len(strings.Fields(s.Text()))
+		if words < minCandidateWords {
+			return
+		}
+
+		add(s.Parent(), float64(words))
+		add(s.Parent().Parent(), float64(words)/2)
+	})
+
+	var cands []*extractCandidate
+	for _, c := range byNode {
+		s := c.sel
+		text := strings.Fields(s.Text())
+		c.Words = len(text)
+		if c.Words == 0 {
+			continue
+		}
+
+		links := len(strings.Fields(s.Find("a").Text()))
+		c.LinkDensity = float64(links) / float64(c.Words)
+		c.Estimate *= 1 - c.LinkDensity
+		c.Chosen = top != nil && top.Length() > 0 && s.Get(0) == top.Get(0)
+
+		if len(text) > 30 {
+			text = append(text[:30], "…")
+		}
+		c.Text = strings.Join(text, " ")
+
+		cands = append(cands, c)
+	}
+
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].Estimate > cands[j].Estimate
+	})
+
+	if len(cands) > maxDebugCandidates {
+		cands = cands[:maxDebugCandidates]
+	}
+
+	return cands
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/thatguystone/swan"
+)
+
+type feedCandidate struct {
+	URL   string `json:"url"`
+	Title string `json:"title,omitempty"`
+	Type  string `json:"type,omitempty"`
+	score int
+}
+
+// multipleFeedsError is returned when a landing page links to several feeds
+// and there's no telling which one the user wants.
+type multipleFeedsError struct {
+	feeds []feedCandidate
+}
+
+// A feedChoice is a feed on the chooser, and where picking it leads.
+type feedChoice struct {
+	feedCandidate
+	Link string
+}
+
+var (
+	// All the probes for a page share this, however many there are; swapped
+	// out in tests
+	probeTimeout = 5 * time.Second
+
+	linkAlt = cascadia.MustCompile(
+		"link[rel~=alternate][type=\"application/rss+xml\"][href], " +
+			"link[rel~=alternate][type=\"application/atom+xml\"][href], " +
+			"link[rel~=alternate][type=\"application/feed+json\"][href]")
+
+	// Paths tried, in order, when a page doesn't bother to link its feed
+	probePaths = []string{
+		"feed",
+		"rss.xml",
+		"atom.xml",
+		"index.xml",
+		"feed.json",
+	}
+
+	// Preferred when a site offers the same feed in several formats
+	feedTypeRank = map[string]int{
+		"application/rss+xml":   2,
+		"application/atom+xml":  1,
+		"application/feed+json": 0,
+	}
+
+	feedChooser = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<head>
+	<title>OhMyRSS: Pick a Feed</title>
+	<meta http-equiv="content-type" content="text/html; charset=utf-8"/>
+</head>
+<body>
+	<h1>This page has more than one feed</h1>
+	<ul>
+	{{ range . }}
+		<li><a href="{{ .Link }}">{{ if .Title }}{{ .Title }}{{ else }}{{ .URL }}{{ end }}</a></li>
+	{{ end }}
+	</ul>
+</body>`))
+)
+
+func (e *multipleFeedsError) Error() string {
+	return "found multiple feeds on this page"
+}
+
+// serveChooser lets the reader pick one of a page's feeds. Each links back
+// to the same request, options and all, for just that feed.
+func serveChooser(w http.ResponseWriter, req *http.Request, auth feedAuth, cands []feedCandidate) {
+	choices := make([]feedChoice, 0, len(cands))
+	for _, c := range cands {
+		link, err := feedLink(req, auth, c.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		choices = append(choices, feedChoice{
+			feedCandidate: c,
+			Link:          link,
+		})
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusMultipleChoices)
+	feedChooser.Execute(w, choices)
+}
+
+func checkLandingPage(ctx context.Context, u *url.URL, content string) (redirectURL string, err error) {
+	// Well, maybe we're looking at a landing page...
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return
+	}
+
+	cands := findFeedLinks(u, doc)
+	if len(cands) == 0 {
+		redirectURL = probeFeeds(ctx, u)
+		if redirectURL == "" {
+			err = errInvalidPage
+		}
+
+		return
+	}
+
+	rankFeeds(cands)
+
+	best := cands[0]
+	tied := 1
+	for tied < len(cands) && cands[tied].score == best.score {
+		tied++
+	}
+
+	if tied > 1 {
+		err = &multipleFeedsError{feeds: cands[:tied]}
+		return
+	}
+
+	redirectURL = best.URL
+	return
+}
+
+// discoverFeeds lists the feeds a page offers, most plausible first. A feed
+// offers itself.
+func discoverFeeds(ctx context.Context, u *url.URL) ([]feedCandidate, error) {
+	body, err := httpGetURL(ctx, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	in, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err = maybeGunzip(in)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err = swan.ToUtf8(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if isFeed(in) {
+		return []feedCandidate{{URL: u.String()}}, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+
+	cands := findFeedLinks(u, doc)
+	if len(cands) == 0 {
+		if pu := probeFeeds(ctx, u); pu != "" {
+			cands = append(cands, feedCandidate{URL: pu})
+		}
+	}
+
+	rankFeeds(cands)
+	return cands, nil
+}
+
+func findFeedLinks(u *url.URL, doc *goquery.Document) (cands []feedCandidate) {
+	seen := map[string]bool{}
+
+	doc.FindMatcher(linkAlt).Each(func(i int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		feedURL, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return
+		}
+
+		au := u.ResolveReference(feedURL)
+		if au.Scheme != "http" && au.Scheme != "https" {
+			return
+		}
+
+		abs := au.String()
+		if seen[abs] {
+			return
+		}
+		seen[abs] = true
+
+		title, _ := s.Attr("title")
+		typ, _ := s.Attr("type")
+		cands = append(cands, feedCandidate{
+			URL:   abs,
+			Title: strings.TrimSpace(title),
+			Type:  typ,
+		})
+	})
+
+	return
+}
+
+// rankFeeds sorts candidates from most to least plausible. Comment feeds and
+// category/tag feeds lose to the site's main feed; format only breaks ties.
+func rankFeeds(cands []feedCandidate) {
+	for i := range cands {
+		c := &cands[i]
+		score := 0
+
+		lu := strings.ToLower(c.URL)
+		lt := strings.ToLower(c.Title)
+
+		if strings.Contains(lu, "comment") || strings.Contains(lt, "comment") {
+			score -= 3
+		}
+
+		for _, sub := range []string{"/category/", "/tag/", "/author/", "/search"} {
+			if strings.Contains(lu, sub) {
+				score -= 2
+				break
+			}
+		}
+
+		c.score = score*10 + feedTypeRank[c.Type]
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		return cands[i].score > cands[j].score
+	})
+}
+
+// probeFeeds looks for a feed at the usual places, preferring those next to
+// the page over those at the root of the site. Every place is tried at once,
+// and they all have to answer within probeTimeout.
+func probeFeeds(ctx context.Context, u *url.URL) string {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	dirs := []string{"/"}
+	if dir := path.Dir(u.Path); dir != "/" && dir != "." {
+		dirs = []string{dir + "/", "/"}
+	}
+
+	var urls []string
+	var found []chan bool
+	for _, dir := range dirs {
+		for _, p := range probePaths {
+			pu := *u
+			pu.Path = path.Join(dir, p)
+			pu.RawPath = ""
+			pu.RawQuery = ""
+			pu.Fragment = ""
+
+			ch := make(chan bool, 1)
+			go func() {
+				ch <- isFeedURL(ctx, &pu)
+			}()
+
+			urls = append(urls, pu.String())
+			found = append(found, ch)
+		}
+	}
+
+	// Once a place is a feed, nothing after it matters
+	for i, ch := range found {
+		if <-ch {
+			return urls[i]
+		}
+	}
+
+	return ""
+}
+
+func isFeedURL(ctx context.Context, u *url.URL) bool {
+	body, err := httpGetURL(ctx, u, nil)
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+
+	in, err := ioutil.ReadAll(body)
+	if err != nil {
+		return false
+	}
+
+	in, err = swan.ToUtf8(in)
+	if err != nil {
+		return false
+	}
+
+	return isFeed(in)
+}
+
+func isFeed(in []byte) bool {
+	var rss Rss
+	if xml.Unmarshal(in, &rss) == nil {
+		return true
+	}
+
+	var atom Atom
+	if xml.Unmarshal(in, &atom) == nil {
+		return true
+	}
+
+	var jf JSONFeed
+	return json.Unmarshal(in, &jf) == nil &&
+		strings.HasPrefix(jf.Version, jsonFeedVersionPrefix)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// itemFilter decides which items of a feed are worth extracting, and in
+// what order. A nil filter lets everything through untouched.
+type itemFilter struct {
+	include    *regexp.Regexp
+	exclude    *regexp.Regexp
+	categories []string
+	author     string
+	minWords   int
+
+	since  time.Time
+	until  time.Time
+	order  string
+	offset int
+	limit  int
+}
+
+const (
+	orderNewest = "newest"
+	orderOldest = "oldest"
+)
+
+// parseItemFilter reads filtering options from a request:
+//
+//	include=<regex>   only items whose title or description match
+//	exclude=<regex>   drop items whose title or description match
+//	category=<name>   only items in this category (may be repeated)
+//	author=<name>     only items by an author containing this
+//	minwords=<n>      drop items whose extracted content is shorter
+//	since=<when>      drop items older than this
+//	until=<when>      drop items newer than this
+//	sort=<order>      "newest" or "oldest" first; feed order otherwise
+//	offset=<n>        skip this many items
+//	max=<n>           keep at most this many items
+//
+// A <when> is either a date or a duration before now, like 36h or 7d.
+func parseItemFilter(req *http.Request) (*itemFilter, error) {
+	f := &itemFilter{}
+	enabled := false
+
+	res := []struct {
+		param string
+		re    **regexp.Regexp
+	}{
+		{"include", &f.include},
+		{"exclude", &f.exclude},
+	}
+
+	for _, r := range res {
+		v := req.FormValue(r.param)
+		if v == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s regex: %s", r.param, err)
+		}
+
+		*r.re = re
+		enabled = true
+	}
+
+	for _, c := range req.Form["category"] {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			f.categories = append(f.categories, strings.ToLower(c))
+			enabled = true
+		}
+	}
+
+	f.author = strings.ToLower(strings.TrimSpace(req.FormValue("author")))
+	if f.author != "" {
+		enabled = true
+	}
+
+	if v := req.FormValue("minwords"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid minwords: %s", v)
+		}
+
+		f.minWords = n
+		enabled = true
+	}
+
+	times := []struct {
+		param string
+		t     *time.Time
+	}{
+		{"since", &f.since},
+		{"until", &f.until},
+	}
+
+	for _, t := range times {
+		v := req.FormValue(t.param)
+		if v == "" {
+			continue
+		}
+
+		when, ok := parseWhen(v, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %s", t.param, v)
+		}
+
+		*t.t = when
+		enabled = true
+	}
+
+	switch f.order = strings.ToLower(req.FormValue("sort")); f.order {
+	case "":
+	case orderNewest, orderOldest:
+		enabled = true
+	default:
+		return nil, fmt.Errorf("invalid sort: %s", f.order)
+	}
+
+	ints := []struct {
+		param string
+		n     *int
+	}{
+		{"offset", &f.offset},
+		{"max", &f.limit},
+	}
+
+	for _, i := range ints {
+		v := req.FormValue(i.param)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", i.param, v)
+		}
+
+		*i.n = n
+		enabled = true
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// parseWhen reads either a date or a duration before now.
+func parseWhen(v string, now time.Time) (time.Time, bool) {
+	if t, ok := parseDate(v); ok {
+		return t, true
+	}
+
+	if strings.HasSuffix(v, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+		if err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), true
+		}
+	}
+
+	d, err := time.ParseDuration(v)
+	if err == nil && d >= 0 {
+		return now.Add(-d), true
+	}
+
+	return time.Time{}, false
+}
+
+// perSource is the filter each feed of a merge gets: every source must
+// provide enough items to fill the window, which is only cut once all of
+// them are combined.
+func (f *itemFilter) perSource() *itemFilter {
+	if f == nil {
+		return nil
+	}
+
+	pf := *f
+	pf.offset = 0
+	if pf.limit > 0 {
+		pf.limit += f.offset
+	}
+
+	return &pf
+}
+
+// merged is the filter for the combined items of a merge, which were
+// already matched as part of their sources.
+func (f *itemFilter) merged() *itemFilter {
+	if f == nil {
+		return nil
+	}
+
+	return &itemFilter{
+		since:  f.since,
+		until:  f.until,
+		order:  f.order,
+		offset: f.offset,
+		limit:  f.limit,
+	}
+}
+
+// selectItems applies matching, the date window, ordering and paging to n
+// items, returning the indexes of the items to keep, in order.
+func (f *itemFilter) selectItems(
+	n int,
+	match func(i int) bool,
+	date func(i int) time.Time) []int {
+
+	// Dates are parsed once, not on every comparison
+	dates := make([]time.Time, n)
+
+	idx := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if !match(i) {
+			continue
+		}
+
+		dates[i] = date(i)
+
+		// Items without dates can't be judged, so they're kept
+		if d := dates[i]; !d.IsZero() {
+			if !f.since.IsZero() && d.Before(f.since) {
+				continue
+			}
+
+			if !f.until.IsZero() && d.After(f.until) {
+				continue
+			}
+		}
+
+		idx = append(idx, i)
+	}
+
+	if f.order != "" {
+		sort.SliceStable(idx, func(i, j int) bool {
+			di, dj := dates[idx[i]], dates[idx[j]]
+			if f.order == orderOldest {
+				return di.Before(dj)
+			}
+
+			return di.After(dj)
+		})
+	}
+
+	if f.offset >= len(idx) {
+		return idx[:0]
+	}
+	idx = idx[f.offset:]
+
+	if f.limit > 0 && f.limit < len(idx) {
+		idx = idx[:f.limit]
+	}
+
+	return idx
+}
+
+func (f *itemFilter) match(title, desc string, cats []string, authors ...string) bool {
+	if f == nil {
+		return true
+	}
+
+	text := title + "\n" + desc
+	if f.include != nil && !f.include.MatchString(text) {
+		return false
+	}
+
+	if f.exclude != nil && f.exclude.MatchString(text) {
+		return false
+	}
+
+	if len(f.categories) > 0 && !f.inCategory(cats) {
+		return false
+	}
+
+	if f.author != "" {
+		found := false
+		for _, a := range authors {
+			if strings.Contains(strings.ToLower(a), f.author) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *itemFilter) inCategory(cats []string) bool {
+	for _, c := range cats {
+		c = strings.ToLower(strings.TrimSpace(c))
+		for _, want := range f.categories {
+			if c == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// enoughWords checks the word count of some HTML against minwords.
+func (f *itemFilter) enoughWords(html string) bool {
+	if f == nil || f.minWords == 0 {
+		return true
+	}
+
+	text := html
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err == nil {
+		text = doc.Text()
+	}
+
+	return len(strings.Fields(text)) >= f.minWords
+}
+
+func (f *itemFilter) rssItems(items []*RssItem) []*RssItem {
+	if f == nil {
+		return items
+	}
+
+	idx := f.selectItems(len(items),
+		func(i int) bool {
+			item := items[i]
+			return f.match(item.Title, item.Description, item.Categories,
+				item.Author, item.Creator)
+		},
+		func(i int) time.Time {
+			return rssItemDate(items[i])
+		})
+
+	kept := make([]*RssItem, 0, len(idx))
+	for _, i := range idx {
+		kept = append(kept, items[i])
+	}
+
+	return kept
+}
+
+func (f *itemFilter) atomEntries(entries []*AtomEntry) []*AtomEntry {
+	if f == nil {
+		return entries
+	}
+
+	idx := f.selectItems(len(entries),
+		func(i int) bool {
+			e := entries[i]
+
+			desc := ""
+			if e.Content != nil {
+				desc = e.Content.Content
+			} else if e.Summary != nil {
+				desc = e.Summary.Content
+			}
+
+			var cats []string
+			for _, c := range e.Categories {
+				cats = append(cats, c.Term, c.Label)
+			}
+
+			author := ""
+			if e.Author != nil {
+				author = e.Author.Name
+			}
+
+			return f.match(e.Title, desc, cats, author)
+		},
+		func(i int) time.Time {
+			return atomEntryDate(entries[i])
+		})
+
+	kept := make([]*AtomEntry, 0, len(idx))
+	for _, i := range idx {
+		kept = append(kept, entries[i])
+	}
+
+	return kept
+}
+
+func (f *itemFilter) jsonItems(items []*JSONItem) []*JSONItem {
+	if f == nil {
+		return items
+	}
+
+	idx := f.selectItems(len(items),
+		func(i int) bool {
+			item := items[i]
+			desc := item.ContentHTML + "\n" + item.ContentText + "\n" + item.Summary
+
+			author := ""
+			if item.Author != nil {
+				author = item.Author.Name
+			}
+
+			return f.match(item.Title, desc, item.Tags, author)
+		},
+		func(i int) time.Time {
+			return jsonItemDate(items[i])
+		})
+
+	kept := make([]*JSONItem, 0, len(idx))
+	for _, i := range idx {
+		kept = append(kept, items[i])
+	}
+
+	return kept
+}
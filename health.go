@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A checkResult is how one of readyz's dependencies is doing.
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Ms     int64  `json:"ms"`
+}
+
+type readyCheck func(ctx context.Context) error
+
+const (
+	readyTimeout = 2 * time.Second
+
+	checkOK       = "ok"
+	checkFailed   = "fail"
+	checkDisabled = "disabled"
+)
+
+var (
+	errConfigNotLoaded = errors.New("config not loaded")
+	errCheckDisabled   = errors.New("disabled")
+
+	// Swapped out in tests
+	lookupHost = net.DefaultResolver.LookupHost
+)
+
+// healthzHandler says the process is up, and nothing more.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// readyzHandler says whether everything a feed request depends on is
+// working, check by check. Anything failing makes it a 503.
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]readyCheck{
+		"config":  checkConfig,
+		"cache":   checkCache,
+		"dns":     checkDNS,
+		"archive": checkBolt(archive),
+		"index":   checkBolt(searchIndex),
+	}
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+
+	results := make(map[string]checkResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check readyCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+
+			res := checkResult{
+				Status: checkOK,
+				Ms:     time.Since(start).Milliseconds(),
+			}
+
+			if err == errCheckDisabled {
+				res.Status = checkDisabled
+			} else if err != nil {
+				res.Status = checkFailed
+				res.Error = err.Error()
+			}
+
+			mtx.Lock()
+			results[name] = res
+			mtx.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := checkOK
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Status == checkFailed {
+			status = checkFailed
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	}, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+// checkConfig reports on the config that's in use, not whatever's on disk:
+// a file that's halfway through being edited isn't anyone's problem until
+// it's reloaded.
+func checkConfig(ctx context.Context) error {
+	if getConfig() == nil {
+		return errConfigNotLoaded
+	}
+
+	if err := lastReloadError(); err != nil {
+		return fmt.Errorf("last reload failed: %s", err)
+	}
+
+	return nil
+}
+
+func checkCache(ctx context.Context) error {
+	if mc == nil {
+		return errCheckDisabled
+	}
+
+	// The client has its own timeout
+	return mc.Ping()
+}
+
+func checkDNS(ctx context.Context) error {
+	host := getConfig().ReadyDNSHost
+	if host == "" {
+		u, err := url.Parse(faviconURL("example.com"))
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+			return errCheckDisabled
+		}
+
+		host = u.Hostname()
+	}
+
+	_, err := lookupHost(ctx, host)
+	return err
+}
+
+func checkBolt(db *bolt.DB) readyCheck {
+	return func(ctx context.Context) error {
+		if db == nil {
+			return errCheckDisabled
+		}
+
+		return db.View(func(*bolt.Tx) error {
+			return nil
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,18 +9,26 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 )
 
+// A fetchScope is what a fetch is for, which decides where it may go.
+type fetchScope int
+
+type fetchScopeKey struct{}
+
+// fetchTransport is the client's transport, which holds every request to the
+// rules of its fetchScope.
+type fetchTransport struct{}
+
 const (
-	maxRespBytes = 4 * 1024 * 1024
+	scopeFeed fetchScope = iota
+	scopeArticle
+
+	// Our own requests, like tracking hits, go wherever they're configured to
+	scopeOwn
 )
 
 var (
-	httpClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
-
 	errBadHost = errors.New("bad hostname")
 
 	httpLocalDisabled = false
@@ -28,6 +37,13 @@ var (
 		"127.0.0.0/8",
 		"::1/128",
 	}
+
+	// Headers httpGetRemoteIP knows how to read
+	proxyHeaders = map[string]bool{
+		"X-Forwarded-For": true,
+		"Forwarded":       true,
+		"X-Real-IP":       true,
+	}
 )
 
 func init() {
@@ -70,50 +86,182 @@ func httpTestLocal(u *url.URL) error {
 	return nil
 }
 
-func httpGet(u string) (body io.ReadCloser, err error) {
+// withFetchScope marks what everything fetched with ctx is for. Anything
+// unmarked is a feed.
+func withFetchScope(ctx context.Context, scope fetchScope) context.Context {
+	return context.WithValue(ctx, fetchScopeKey{}, scope)
+}
+
+// checkFetch decides whether u may be fetched. Every request the client sends
+// goes through it, so it doesn't matter how a URL turned up: named by the
+// client, found in a sitemap or on a landing page, or redirected to.
+func checkFetch(ctx context.Context, u *url.URL) error {
+	scope, _ := ctx.Value(fetchScopeKey{}).(fetchScope)
+
+	switch scope {
+	case scopeFeed:
+		if !getConfig().FeedHosts.allows(u) {
+			return errFeedRefused
+		}
+
+		if k := apiKeyFrom(ctx); k != nil && !k.allowsHost(u.Host) {
+			return errFeedRefused
+		}
+
+	case scopeArticle:
+		if !getConfig().ArticleHosts.allows(u) {
+			return errArticleRefused
+		}
+	}
+
+	return nil
+}
+
+// RoundTrip checks every request the client sends, redirects included.
+func (fetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := checkFetch(req.Context(), req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func httpGet(ctx context.Context, u string) (body io.ReadCloser, err error) {
 	ur, err := url.Parse(u)
 	if err != nil {
 		return nil, err
 	}
 
-	return httpGetURL(ur)
+	return httpGetURL(ctx, ur, nil)
+}
+
+func httpGetURL(ctx context.Context, u *url.URL, cred *credential) (body io.ReadCloser, err error) {
+	resp, err := httpDo(ctx, u, cred)
+	if err != nil {
+		return
+	}
+
+	body = resp.Body
+	return
 }
 
-func httpGetURL(u *url.URL) (body io.ReadCloser, err error) {
+// httpDo fetches a URL, authenticating with the given credential or, if nil,
+// any credential stored for the host. Userinfo never goes out on the wire
+// unless it was the credential given.
+func httpDo(ctx context.Context, u *url.URL, cred *credential) (resp *http.Response, err error) {
 	err = httpTestLocal(u)
 	if err != nil {
 		return
 	}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	uc, cu := credentialFromURL(u)
+	if cred == nil {
+		cred = uc
+	}
+
+	if cred == nil {
+		cred = lookupCredential(cu)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", cu.String(), nil)
 	if err != nil {
 		err = fmt.Errorf("could not create new request: %s", err)
 		return
 	}
 
-	resp, err := httpClient.Do(req)
+	if cred != nil {
+		cred.apply(req)
+	}
+
+	resp, err = getConfig().client.Do(req)
 	if err != nil {
+		requestLogFrom(ctx).fetched(cu.Redacted(), 0, err)
+
+		// A refused redirect is still a refusal
+		if ue, ok := err.(*url.Error); ok && (ue.Err == errFeedRefused || ue.Err == errArticleRefused) {
+			err = ue.Err
+			return
+		}
+
 		err = fmt.Errorf("could not load URL: %s", err)
 		return
 	}
 
+	requestLogFrom(ctx).fetched(cu.Redacted(), resp.StatusCode, nil)
+
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		resp.Body = nil
 		err = fmt.Errorf("could not load URL: status code %d", resp.StatusCode)
+		resp = nil
 		return
 	}
 
-	body = http.MaxBytesReader(nil, resp.Body, maxRespBytes)
+	resp.Body = http.MaxBytesReader(nil, resp.Body, getConfig().MaxResponseBytes)
 	return
 }
 
+// httpGetRemoteIP finds who's asking. Only the header the proxies are
+// configured to set is looked at, and only when it comes from a trusted
+// proxy, and then only as far back as the chain of trusted proxies goes:
+// anyone else could say anything.
 func httpGetRemoteIP(req *http.Request) string {
-	if ips := req.Header.Get("X-Forwarded-For"); len(ips) > 0 {
-		ipsa := strings.Split(ips, ",")
-		return strings.TrimSpace(ipsa[0])
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+	c := getConfig()
+	if !c.trustsProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	vals := req.Header.Values(c.ProxyHeader)
+	switch c.ProxyHeader {
+	case "Forwarded":
+		hops = forwardedFor(strings.Join(vals, ","))
+	default:
+		hops = strings.Split(strings.Join(vals, ","), ",")
+	}
+
+	// The nearest hop that isn't one of ours is the client
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop.String()
+		if !c.trustsProxy(ip) {
+			break
+		}
 	}
 
-	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 	return ip
 }
+
+// forwardedFor pulls the for= addresses out of an RFC 7239 Forwarded header,
+// without ports. Hidden and unknown clients are kept, as something that's
+// not an address.
+func forwardedFor(fwd string) (hops []string) {
+	for _, elem := range strings.Split(fwd, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+				continue
+			}
+
+			v := strings.Trim(kv[1], `"`)
+			if strings.HasPrefix(v, "[") {
+				// [2001:db8::1]:4711
+				if end := strings.Index(v, "]"); end > 0 {
+					v = v[1:end]
+				}
+			} else if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+
+			hops = append(hops, v)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"time"
+)
+
+// From: https://github.com/gorilla/feeds/blob/master/json.go
+
+const (
+	jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+	jsonFeedVersion       = jsonFeedVersionPrefix + "1.1"
+)
+
+type JSONAuthor struct {
+	Name   string `json:"name,omitempty"`
+	Url    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type JSONAttachment struct {
+	Url      string `json:"url"`
+	MIMEType string `json:"mime_type"`
+	Title    string `json:"title,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Duration int64  `json:"duration_in_seconds,omitempty"`
+}
+
+type JSONItem struct {
+	Id            string            `json:"id"`
+	Url           string            `json:"url,omitempty"`
+	ExternalUrl   string            `json:"external_url,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	ContentHTML   string            `json:"content_html,omitempty"`
+	ContentText   string            `json:"content_text,omitempty"`
+	Summary       string            `json:"summary,omitempty"`
+	Image         string            `json:"image,omitempty"`
+	BannerImage   string            `json:"banner_image,omitempty"`
+	PublishedDate string            `json:"date_published,omitempty"`
+	ModifiedDate  string            `json:"date_modified,omitempty"`
+	Author        *JSONAuthor       `json:"author,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Attachments   []*JSONAttachment `json:"attachments,omitempty"`
+}
+
+type JSONFeed struct {
+	Version     string      `json:"version"`
+	Title       string      `json:"title"`
+	HomePageUrl string      `json:"home_page_url,omitempty"`
+	FeedUrl     string      `json:"feed_url,omitempty"`
+	Description string      `json:"description,omitempty"`
+	UserComment string      `json:"user_comment,omitempty"`
+	NextUrl     string      `json:"next_url,omitempty"`
+	Icon        string      `json:"icon,omitempty"`
+	Favicon     string      `json:"favicon,omitempty"`
+	Author      *JSONAuthor `json:"author,omitempty"`
+	Expired     *bool       `json:"expired,omitempty"`
+	Items       []*JSONItem `json:"items"`
+}
+
+// jsonDate rewrites a date as RFC 3339, dropping anything unparseable.
+func jsonDate(d string) string {
+	t, ok := parseDate(d)
+	if !ok {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// rssToJSONFeed converts an RSS feed to a JSON Feed.
+func rssToJSONFeed(rss *Rss) *JSONFeed {
+	ch := rss.Channel
+	jf := &JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       ch.Title,
+		HomePageUrl: ch.Link,
+		Description: ch.Description,
+		Items:       []*JSONItem{},
+	}
+
+	if ch.Image != nil {
+		jf.Favicon = ch.Image.Url
+	}
+
+	for _, item := range ch.Items {
+		ji := &JSONItem{
+			Id:            item.Guid,
+			Url:           item.Link,
+			Title:         item.Title,
+			ContentHTML:   item.Description,
+			PublishedDate: jsonDate(item.PubDate),
+			Tags:          item.Categories,
+		}
+
+		if ji.Id == "" {
+			ji.Id = item.Link
+		}
+
+		author := item.Author
+		if author == "" {
+			author = item.Creator
+		}
+
+		if author != "" {
+			ji.Author = &JSONAuthor{Name: author}
+		}
+
+		if e := item.Enclosure; e != nil && e.Url != "" {
+			ji.Attachments = []*JSONAttachment{{
+				Url:      e.Url,
+				MIMEType: e.Type,
+			}}
+		}
+
+		jf.Items = append(jf.Items, ji)
+	}
+
+	return jf
+}
+
+// atomToJSONFeed converts an Atom feed to a JSON Feed.
+func atomToJSONFeed(atom *Atom) *JSONFeed {
+	jf := &JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       atom.Title,
+		Description: atom.Subtitle,
+		Icon:        atom.Logo,
+		Favicon:     atom.Icon,
+		Items:       []*JSONItem{},
+	}
+
+	if atom.Link != nil {
+		jf.HomePageUrl = atom.Link.Href
+	}
+
+	for _, e := range atom.Entries {
+		ji := &JSONItem{
+			Id:            e.Id,
+			Title:         e.Title,
+			PublishedDate: jsonDate(e.Published),
+			ModifiedDate:  jsonDate(e.Updated),
+		}
+
+		if e.Link != nil {
+			ji.Url = e.Link.Href
+		}
+
+		if e.Content != nil {
+			ji.ContentHTML = e.Content.Content
+		}
+
+		if e.Summary != nil {
+			ji.Summary = e.Summary.Content
+			if ji.ContentHTML == "" {
+				ji.ContentHTML = e.Summary.Content
+			}
+		}
+
+		if e.Author != nil && e.Author.Name != "" {
+			ji.Author = &JSONAuthor{
+				Name: e.Author.Name,
+				Url:  e.Author.Uri,
+			}
+		}
+
+		for _, c := range e.Categories {
+			ji.Tags = append(ji.Tags, c.Term)
+		}
+
+		jf.Items = append(jf.Items, ji)
+	}
+
+	return jf
+}
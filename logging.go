@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+// A requestLog collects what happened while serving a request, to be logged
+// as a single line once it's done.
+type requestLog struct {
+	msg     string
+	id      string
+	ip      string
+	start   time.Time
+	sampled bool
+
+	mtx      sync.Mutex
+	urls     []string
+	items    int
+	articles []articleLog
+	upstream []upstreamLog
+}
+
+type articleLog struct {
+	URL     string `json:"url"`
+	Outcome string `json:"outcome"`
+	Ms      int64  `json:"ms"`
+}
+
+type upstreamLog struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// statusWriter remembers the status a response was sent with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+type requestLogKey struct{}
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+var (
+	logLevels = map[string]logLevel{
+		"debug": logDebug,
+		"info":  logInfo,
+		"warn":  logWarn,
+		"error": logError,
+	}
+
+	logMtx sync.Mutex
+	logOut io.Writer = os.Stderr
+
+	// IDs we'll take from a proxy rather than make up our own
+	reRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+func (l logLevel) String() string {
+	for name, ll := range logLevels {
+		if ll == l {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// logEvent writes a JSON line, if level is at or above the configured one.
+func logEvent(level logLevel, msg string, fields map[string]interface{}) {
+	if level < logLevels[getConfig().LogLevel] {
+		return
+	}
+
+	ev := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		ev[k] = v
+	}
+
+	ev["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	ev["level"] = level.String()
+	ev["msg"] = msg
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{
+			"level": logError.String(),
+			"msg":   "log: " + err.Error(),
+		})
+	}
+
+	logMtx.Lock()
+	logOut.Write(append(b, '\n'))
+	logMtx.Unlock()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newRequestLog(req *http.Request, msg string) *requestLog {
+	rl := &requestLog{
+		msg:     msg,
+		id:      newRequestID(),
+		ip:      httpGetRemoteIP(req),
+		start:   time.Now(),
+		sampled: mrand.Float64() < getConfig().LogSample,
+	}
+
+	// Keep the proxy's ID so its logs line up with ours
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	id := req.Header.Get("X-Request-Id")
+	if reRequestID.MatchString(id) && getConfig().trustsProxy(ip) {
+		rl.id = id
+	}
+
+	return rl
+}
+
+func withRequestLog(ctx context.Context, rl *requestLog) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, rl)
+}
+
+// logRequest starts the log of a request, logged as msg. The returned writer
+// and request have to be used in its place, and done must be deferred: it
+// writes the log, and turns a panic into a 500.
+func logRequest(w http.ResponseWriter, req *http.Request, msg string) (http.ResponseWriter, *http.Request, func()) {
+	rl := newRequestLog(req, msg)
+	req = req.WithContext(withRequestLog(req.Context(), rl))
+
+	sw := &statusWriter{ResponseWriter: w}
+	sw.Header().Set("X-Request-Id", rl.id)
+
+	done := func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			logEvent(logError, "panic", map[string]interface{}{
+				"request_id": rl.id,
+				"ip":         rl.ip,
+				"error":      fmt.Sprint(err),
+				"stack":      string(buf),
+			})
+
+			sw.WriteHeader(500)
+		}
+
+		rl.done(sw.status)
+	}
+
+	return sw, req, done
+}
+
+// logRequests wraps h so that its requests are logged like feeds are.
+func logRequests(msg string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w, req, done := logRequest(w, req, msg)
+		defer done()
+
+		h(w, req)
+	}
+}
+
+// requestLogFrom finds the log of the request ctx belongs to. Nothing
+// outside of a logged request has one, which is fine: a nil *requestLog
+// ignores everything.
+func requestLogFrom(ctx context.Context) *requestLog {
+	rl, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return rl
+}
+
+// redactURL strips any credentials from a URL that's about to be logged.
+func redactURL(raw string) string {
+	u, err := parseFeedURL(raw)
+	if err != nil {
+		return "invalid"
+	}
+
+	_, u = credentialFromURL(u)
+	return u.Redacted()
+}
+
+// setURLs notes the URLs a request is for, minus any credentials in them.
+func (rl *requestLog) setURLs(urls []string) {
+	if rl == nil {
+		return
+	}
+
+	redacted := make([]string, 0, len(urls))
+	for _, raw := range urls {
+		redacted = append(redacted, redactURL(raw))
+	}
+
+	rl.mtx.Lock()
+	rl.urls = redacted
+	rl.mtx.Unlock()
+}
+
+func (rl *requestLog) addItems(n int) {
+	if rl == nil {
+		return
+	}
+
+	rl.mtx.Lock()
+	rl.items += n
+	rl.mtx.Unlock()
+}
+
+func (rl *requestLog) setItems(n int) {
+	if rl == nil {
+		return
+	}
+
+	rl.mtx.Lock()
+	rl.items = n
+	rl.mtx.Unlock()
+}
+
+func (rl *requestLog) article(link, outcome string, start time.Time) {
+	if rl == nil {
+		return
+	}
+
+	rl.mtx.Lock()
+	rl.articles = append(rl.articles, articleLog{
+		URL:     redactURL(link),
+		Outcome: outcome,
+		Ms:      time.Since(start).Milliseconds(),
+	})
+	rl.mtx.Unlock()
+}
+
+func (rl *requestLog) fetched(u string, status int, err error) {
+	if rl == nil {
+		return
+	}
+
+	ul := upstreamLog{
+		URL:    u,
+		Status: status,
+	}
+
+	if err != nil {
+		ul.Error = err.Error()
+	}
+
+	rl.mtx.Lock()
+	rl.upstream = append(rl.upstream, ul)
+	rl.mtx.Unlock()
+}
+
+// done logs the request. Only a sample of the ones that went well are
+// logged, unless debugging; trouble always is.
+func (rl *requestLog) done(status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	level := logInfo
+	switch {
+	case status >= 500:
+		level = logError
+	case status >= 400:
+		level = logWarn
+	case !rl.sampled && logLevels[getConfig().LogLevel] > logDebug:
+		return
+	}
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	hits := 0
+	for _, a := range rl.articles {
+		if a.Outcome == "cached" {
+			hits++
+		}
+	}
+
+	logEvent(level, rl.msg, map[string]interface{}{
+		"request_id": rl.id,
+		"ip":         rl.ip,
+		"urls":       rl.urls,
+		"status":     status,
+		"items":      rl.items,
+		"articles":   rl.articles,
+		"cache_hits": hits,
+		"upstream":   rl.upstream,
+		"latency_ms": time.Since(rl.start).Milliseconds(),
+	})
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(b)
+}
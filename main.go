@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"flag"
@@ -13,10 +15,10 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"net/http/fcgi"
 	"net/url"
+	"os"
 	"path"
-	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +31,7 @@ import (
 
 type article struct {
 	FinalURL string
+	Title    string
 	Content  string
 }
 
@@ -37,15 +40,22 @@ type tracking struct {
 	cid   uint32
 	url   string
 	title string
+
+	// Set when nobody's actually reading the feed
+	disabled bool
 }
 
 type feedRequest struct {
 	baseURL *url.URL
+	scrape  *scrapeOptions
+	filter  *itemFilter
+	archive int
 	t       tracking
 }
 
 const (
-	googleFavicon = "https://www.google.com/s2/favicons?domain=%s&alt=feed"
+	maxTrackers  = 32
+	trackTimeout = 10 * time.Second
 )
 
 var (
@@ -55,35 +65,89 @@ var (
 
 	errNoMc        = errors.New("memcache disabled")
 	errInvalidPage = errors.New("could not find a feed on this page")
+	errFeedRefused = errors.New("feeds from this host are not allowed here")
 
-	linkAlt = cascadia.MustCompile(
-		"link[rel=alternate][type=\"application/rss+xml\"][href], " +
-			"link[rel=alternate][type=\"application/atom+xml\"][href]")
+	selOgTitle = cascadia.MustCompile("meta[property=\"og:title\"][content]")
 
 	mc *memcache.Client
+
+	trackers = make(chan struct{}, maxTrackers)
 )
 
 func init() {
 	flag.BoolVar(&runFcgi, "fcgi", false, "run as a fastcgi server")
 	flag.IntVar(&httpPort, "httpPort", 8080, "run a debug server")
 	flag.StringVar(&memcacheServers, "mcServers", "", "comma-separated list of memcache servers")
+	flag.StringVar(&credentialsFile, "credentials", "", "JSON file of per-host credentials for private feeds")
+	flag.StringVar(&bundlesFile, "bundles", "", "JSON file of named bundles of feeds to merge")
+	flag.StringVar(&apiKeysFile, "keys", "", "JSON file of API keys, managed with the keys command")
+	flag.BoolVar(&requireKey, "requireKey", false, "only serve feeds to requests with an API key")
+	flag.StringVar(&archivePath, "archive", "", "path to a database of every article seen, enables ?archive=N")
+	flag.StringVar(&indexPath, "index", "", "path to a full-text index of extracted articles, enables /search")
+	flag.BoolVar(&debugEnabled, "debug", false, "enable /debug/extract to see how articles are extracted")
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n\nflags:\n", cliUsage)
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
-	httpDisableLocal()
 	rand.Seed(time.Now().UnixNano())
 
-	if memcacheServers != "" {
-		mc = memcache.New(strings.Split(memcacheServers, ",")...)
+	c, err := readConfig(configFile)
+	if err != nil {
+		log.Fatalf("invalid config: %s", err)
 	}
 
-	http.HandleFunc("/", feedHandler)
+	err = loadConfigFiles(c)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if runFcgi {
-		fcgi.Serve(nil, nil)
-	} else {
-		http.ListenAndServe(fmt.Sprintf(":%d", httpPort), nil)
+	setConfig(c)
+
+	if c.Archive != "" {
+		err := openArchive(c.Archive)
+		if err != nil {
+			log.Fatalf("failed to open archive: %s", err)
+		}
+	}
+
+	if c.Index != "" {
+		err := openIndex(c.Index)
+		if err != nil {
+			log.Fatalf("failed to open search index: %s", err)
+		}
+	}
+
+	if len(c.MemcacheServers) > 0 {
+		mc = memcache.New(c.MemcacheServers...)
+	}
+
+	// Anything run from a shell may look wherever it likes
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args(), os.Stdout)
+		closeIndex()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	httpDisableLocal()
+
+	registerRoutes(http.DefaultServeMux, c)
+
+	watchConfig()
+
+	err = serve(c.serverConfig)
+	closeIndex()
+	if err != nil {
+		log.Fatalf("server failed: %s", err)
 	}
 }
 
@@ -139,104 +203,377 @@ func cacheArticle(key string, a *article, expire int32) {
 	})
 }
 
-func getArticle(url string) *article {
-	if url == "" {
+func getArticle(ctx context.Context, link string, cred *credential) *article {
+	if link == "" {
+		return nil
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
 		return nil
 	}
 
-	sum := sha1.Sum([]byte(url))
-	key := "ohmyrss_" + base64.StdEncoding.EncodeToString(sum[:])
+	uc, u := credentialFromURL(u)
+	if cred == nil {
+		cred = uc
+	}
+
+	if cred == nil {
+		cred = lookupCredential(u)
+	}
+
+	rl := requestLogFrom(ctx)
+	start := time.Now()
+
+	// Even cached articles are off limits once their host is
+	ctx = withFetchScope(ctx, scopeArticle)
+	if checkFetch(ctx, u) != nil {
+		rl.article(link, "refused", start)
+		return nil
+	}
+
+	key := articleCacheKey(u, cred)
 
 	art, err := hitCache(key)
 	if err == nil {
+		rl.article(link, "cached", start)
 		return art
 	}
 
-	sa, err := swan.FromURL(url)
-	cacheTime := int32(60 * 3)
-	if err == nil {
-		cacheTime = 60 * 60 * 24 * 7
+	art, err = extractArticle(ctx, u, cred)
+
+	// Nobody's waiting for it, which says nothing about the article
+	if ctx.Err() != nil {
+		rl.article(link, "cancelled", start)
+		return nil
 	}
 
-	if sa != nil && sa.TopNode != nil {
-		html, _ := sa.TopNode.Html()
-		art = &article{
-			FinalURL: sa.URL,
-			Content:  strings.TrimSpace(html),
+	ttl := getConfig().FailedArticleTTL
+	outcome := "failed"
+	if err == nil {
+		outcome = "extracted"
+		ttl = getConfig().ArticleTTL
+
+		// Private articles must never turn up in anyone else's search
+		if cred == nil {
+			indexArticle(art)
 		}
 	}
 
-	cacheArticle(key, art, cacheTime)
+	rl.article(link, outcome, start)
+	cacheArticle(key, art, int32(ttl.Seconds()))
 	return art
 }
 
+func articleCacheKey(u *url.URL, cred *credential) string {
+	sum := sha1.Sum([]byte(u.String() + cred.cacheSalt()))
+	return "ohmyrss_" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func extractArticle(ctx context.Context, u *url.URL, cred *credential) (*article, error) {
+	finalURL, html, err := fetchArticleHTML(ctx, u, cred)
+	if err != nil {
+		return nil, err
+	}
+
+	sa, err := swan.FromHTML(finalURL, html)
+	if sa == nil || sa.TopNode == nil {
+		return nil, err
+	}
+
+	return swanArticle(sa, html), err
+}
+
+// fetchArticleHTML gets a page as UTF-8, along with the URL it was finally
+// found at.
+func fetchArticleHTML(ctx context.Context, u *url.URL, cred *credential) (string, []byte, error) {
+	resp, err := httpDo(withFetchScope(ctx, scopeArticle), u, cred)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	html, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	html, err = swan.ToUtf8(html)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return resp.Request.URL.String(), html, nil
+}
+
+func swanArticle(sa *swan.Article, html []byte) *article {
+	content, _ := sa.TopNode.Html()
+	return &article{
+		FinalURL: sa.URL,
+		Title:    pageTitle(html),
+		Content:  strings.TrimSpace(content),
+	}
+}
+
+// pageTitle digs the title out of an article page, for feeds that don't
+// come with one.
+func pageTitle(html []byte) string {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(html))
+	if err != nil {
+		return ""
+	}
+
+	title, _ := doc.FindMatcher(selOgTitle).Attr("content")
+	if title == "" {
+		title = doc.Find("title").First().Text()
+	}
+
+	return strings.Join(strings.Fields(title), " ")
+}
+
 func feedHandler(w http.ResponseWriter, req *http.Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			log.Printf("http: panic serving %v: %v\n%s", req.RemoteAddr, err, buf)
-
-			w.WriteHeader(500)
-		}
-	}()
+	serveFeed(w, req, feedAuth{
+		keyHash: requestKeyHash(req),
+	})
+}
+
+// serveFeed serves the feed a request's query asks for, once auth says it
+// may have it.
+func serveFeed(w http.ResponseWriter, req *http.Request, auth feedAuth) {
+	w, req, done := logRequest(w, req, "feed")
+	defer done()
 
 	req.Body.Close()
 
-	feedURL := req.FormValue("url")
-	if feedURL == "" {
+	title := ""
+	req.ParseForm()
+	feedURLs := req.Form["url"]
+
+	if name := req.FormValue("bundle"); name != "" {
+		b := lookupBundle(name)
+		if b == nil {
+			http.Error(w, "unknown bundle", http.StatusNotFound)
+			return
+		}
+
+		title = b.Title
+		feedURLs = b.URLs
+	}
+
+	requestLogFrom(req.Context()).setURLs(feedURLs)
+
+	if len(feedURLs) == 0 || feedURLs[0] == "" {
 		http.Error(w, "missing url parameter", http.StatusBadRequest)
 		return
 	}
 
-	u, err := url.Parse(feedURL)
-	if err != nil {
-		http.Error(w, "invalid url", http.StatusBadRequest)
+	var frs []feedRequest
+	for _, feedURL := range feedURLs {
+		u, err := parseFeedURL(feedURL)
+		if err != nil {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+
+		fr, err := parseFeedRequest(req, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !getConfig().FeedHosts.allows(u) {
+			http.Error(w, errFeedRefused.Error(), http.StatusForbidden)
+			return
+		}
+
+		frs = append(frs, fr)
+	}
+
+	var hosts []string
+	for _, fr := range frs {
+		hosts = append(hosts, fr.baseURL.Host)
+	}
+
+	if !auth.signed && getConfig().SignedOnly {
+		http.Error(w, errUnsigned.Error(), http.StatusForbidden)
 		return
 	}
 
-	// For schemeless, just add an HTTP and retry
-	if u.Scheme != "http" && u.Scheme != "https" {
-		u, err = url.Parse("http://" + feedURL)
+	ctx, release, ok := admitRequest(w, req, auth.keyHash, hosts)
+	if !ok {
+		return
+	}
+	defer release()
+
+	req = req.WithContext(ctx)
+
+	// Every source of a merge is one reader
+	for i := range frs {
+		frs[i].t.cid = frs[0].t.cid
+	}
+
+	if len(frs) > 1 || req.FormValue("bundle") != "" {
+		feed, err := handleMerged(req.Context(), frs, title)
 		if err != nil {
-			http.Error(w, "invalid url", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+
+		w.Header().Add("Content-Type", feedContentType(feed))
+		w.Write([]byte(feed))
+		return
+	}
+
+	fr := frs[0]
+	feed, redirectURL, err := handleFeed(req.Context(), fr)
+	if err == errFeedRefused {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
 
-	fr := feedRequest{
-		baseURL: u,
-		t: tracking{
-			ip:  httpGetRemoteIP(req),
-			cid: rand.Uint32(),
-		},
+	if mf, ok := err.(*multipleFeedsError); ok {
+		serveChooser(w, req, auth, mf.feeds)
+		return
 	}
 
-	feed, redirectURL, err := handleFeed(fr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if redirectURL != "" {
-		req.URL.RawQuery = fmt.Sprintf("url=%s", redirectURL)
-		http.Redirect(w, req, req.URL.String(), http.StatusMovedPermanently)
+		to, err := feedLink(req, auth, redirectURL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, req, to, http.StatusMovedPermanently)
 		return
 	}
 
-	w.Header().Add("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Add("Content-Type", feedContentType(feed))
 	w.Write([]byte(feed))
 }
 
-func handleFeed(fr feedRequest) (feed string, redirectURL string, err error) {
-	body, err := httpGetURL(fr.baseURL)
+// feedLink points at the same request, options, key and all, for another
+// feed. Signed URLs can only send readers to other signed URLs, which live
+// next to them.
+func feedLink(req *http.Request, auth feedAuth, feedURL string) (string, error) {
+	q := req.URL.Query()
+	q.Set("url", feedURL)
+
+	if auth.signed {
+		return signFeedQuery(q, auth.keyHash)
+	}
+
+	u := *req.URL
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// parseFeedRequest reads the options that shape how a feed is processed.
+func parseFeedRequest(req *http.Request, u *url.URL) (fr feedRequest, err error) {
+	fr.baseURL = u
+
+	fr.scrape, err = parseScrapeOptions(req)
+	if err != nil {
+		return
+	}
+
+	fr.filter, err = parseItemFilter(req)
+	if err != nil {
+		return
+	}
+
+	if v := req.FormValue("archive"); v != "" {
+		fr.archive, err = strconv.Atoi(v)
+		if err != nil || fr.archive < 0 {
+			err = errors.New("invalid archive")
+			return
+		}
+
+		if archive == nil {
+			err = errNoArchive
+			return
+		}
+	}
+
+	fr.t = tracking{
+		ip:  httpGetRemoteIP(req),
+		cid: rand.Uint32(),
+	}
+
+	return
+}
+
+func parseFeedURL(feedURL string) (*url.URL, error) {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// For schemeless, just add an HTTP and retry
+	if u.Scheme != "http" && u.Scheme != "https" {
+		u, err = url.Parse("http://" + feedURL)
+	}
+
+	return u, err
+}
+
+func handleFeed(ctx context.Context, fr feedRequest) (feed string, redirectURL string, err error) {
+	var f interface{}
+	f, redirectURL, err = fetchFeed(ctx, fr)
+	if err != nil || redirectURL != "" {
+		return
+	}
+
+	feed, err = encodeFeed(ctx, f, fr)
+	return
+}
+
+// encodeFeed processes a feed from fetchFeed, encoding it as whatever it
+// started as.
+func encodeFeed(ctx context.Context, f interface{}, fr feedRequest) (feed string, err error) {
+	switch f := f.(type) {
+	case *Rss:
+		feed, err = handleRss(ctx, f, fr)
+	case *Atom:
+		feed, err = handleAtom(ctx, f, fr)
+	case *JSONFeed:
+		feed, err = handleJSONFeed(ctx, f, fr)
+	}
+
+	return
+}
+
+// fetchFeed loads and decodes whatever lives at the request's URL into an
+// *Rss, *Atom or *JSONFeed, without touching any of its items. Anything that
+// isn't a feed but can be turned into one (sitemaps, scraped pages) comes
+// back as an *Rss.
+func fetchFeed(ctx context.Context, fr feedRequest) (f interface{}, redirectURL string, err error) {
+	in, err := fetchFeedBody(ctx, fr.baseURL)
 	if err != nil {
 		return
 	}
+
+	return decodeFeed(ctx, fr, in)
+}
+
+// fetchFeedBody loads a feed exactly as it's served.
+func fetchFeedBody(ctx context.Context, u *url.URL) ([]byte, error) {
+	body, err := openFeed(ctx, u)
+	if err != nil {
+		return nil, err
+	}
 	defer body.Close()
 
-	in, err := ioutil.ReadAll(body)
+	return ioutil.ReadAll(body)
+}
+
+// decodeFeed is fetchFeed, for a body that's already been fetched.
+func decodeFeed(ctx context.Context, fr feedRequest, in []byte) (f interface{}, redirectURL string, err error) {
+	in, err = maybeGunzip(in)
 	if err != nil {
 		return
 	}
@@ -246,31 +583,57 @@ func handleFeed(fr feedRequest) (feed string, redirectURL string, err error) {
 		return
 	}
 
-	var rss Rss
-	err = xml.Unmarshal(in, &rss)
+	rss := &Rss{}
+	err = xml.Unmarshal(in, rss)
 	if err == nil {
-		feed, err = handleRss(&rss, fr)
+		f = rss
 		return
 	}
 
-	var atom Atom
-	err = xml.Unmarshal(in, &atom)
+	atom := &Atom{}
+	err = xml.Unmarshal(in, atom)
 	if err == nil {
-		feed, err = handleAtom(&atom, fr)
+		f = atom
 		return
 	}
 
-	redirectURL = checkLandingPage(fr.baseURL, string(in))
-	if redirectURL != "" {
-		err = nil
-	} else {
-		err = errInvalidPage
+	jf := &JSONFeed{}
+	err = json.Unmarshal(in, jf)
+	if err == nil && strings.HasPrefix(jf.Version, jsonFeedVersionPrefix) {
+		f = jf
+		return
+	}
+
+	var sm Sitemap
+	err = xml.Unmarshal(in, &sm)
+	if err == nil {
+		f = sitemapToRss(&sm, fr)
+		return
 	}
 
+	var smi SitemapIndex
+	err = xml.Unmarshal(in, &smi)
+	if err == nil {
+		f, err = sitemapIndexToRss(ctx, &smi, fr)
+		return
+	}
+
+	if fr.scrape != nil {
+		f, err = scrapeFeed(fr.baseURL, string(in), fr.scrape)
+		return
+	}
+
+	redirectURL, err = checkLandingPage(ctx, fr.baseURL, string(in))
 	return
 }
 
-func handleRss(rss *Rss, fr feedRequest) (string, error) {
+func handleRss(ctx context.Context, rss *Rss, fr feedRequest) (string, error) {
+	processRss(ctx, rss, fr)
+	return xmlEncode(rss)
+}
+
+// processRss replaces every item's content with the full article.
+func processRss(ctx context.Context, rss *Rss, fr feedRequest) {
 	ch := rss.Channel
 	fr.t.title = ch.Title
 	track(fr)
@@ -283,72 +646,202 @@ func handleRss(rss *Rss, fr feedRequest) (string, error) {
 	}
 
 	if ch.Image.Url == "" {
-		ch.Image.Url = fmt.Sprintf(googleFavicon, fr.baseURL.Host)
+		ch.Image.Url = faviconURL(fr.baseURL.Host)
 	}
 
-	for _, item := range ch.Items {
-		a := getArticle(item.Link)
+	var ais []*archivedItem
+	items := fr.filter.rssItems(ch.Items)
+	ch.Items = items[:0]
+
+	for _, item := range items {
+		a := getArticle(ctx, item.Link, fr.articleCredential(item.Link))
 
 		// Don't modify if something went wrong
-		if a == nil {
-			continue
+		if a != nil {
+			if a.FinalURL != "" {
+				item.Link = a.FinalURL
+			}
+
+			if item.Title == "" {
+				item.Title = a.Title
+			}
+
+			if a.Content != "" {
+				item.Description = a.Content
+			}
 		}
 
-		if a.FinalURL != "" {
-			item.Link = a.FinalURL
+		if !fr.filter.enoughWords(item.Description) {
+			continue
 		}
 
-		if a.Content != "" {
-			item.Description = a.Content
+		ch.Items = append(ch.Items, item)
+		if a == nil {
+			continue
 		}
 
+		ais = append(ais, fr.rssToArchive(item))
+
 		fr.t.title = item.Title
 		fr.t.url = item.Link
 		addTracking(&item.Description, fr)
 	}
 
-	return xmlEncode(rss)
+	archiveItems(fr.feedKey(), ais)
+
+	if fr.archive > 0 {
+		if items, err := fr.archivedRssItems(); err == nil {
+			ch.Items = items
+		}
+	}
+
+	requestLogFrom(ctx).addItems(len(ch.Items))
+}
+
+func handleAtom(ctx context.Context, atom *Atom, fr feedRequest) (string, error) {
+	processAtom(ctx, atom, fr)
+	return xmlEncode(atom)
 }
 
-func handleAtom(atom *Atom, fr feedRequest) (string, error) {
+func processAtom(ctx context.Context, atom *Atom, fr feedRequest) {
 	fr.t.title = atom.Title
 	track(fr)
 
 	if atom.Icon == "" {
-		atom.Icon = fmt.Sprintf(googleFavicon, fr.baseURL.Host)
+		atom.Icon = faviconURL(fr.baseURL.Host)
 	}
 
-	for _, item := range atom.Entries {
-		if item.Link == nil {
-			continue
-		}
+	var ais []*archivedItem
+	entries := fr.filter.atomEntries(atom.Entries)
+	atom.Entries = entries[:0]
 
-		a := getArticle(item.Link.Href)
+	for _, item := range entries {
+		var a *article
+		if item.Link != nil {
+			a = getArticle(ctx, item.Link.Href, fr.articleCredential(item.Link.Href))
+		}
 
 		// Don't modify if something went wrong
+		if a != nil {
+			if a.FinalURL != "" {
+				item.Link.Href = a.FinalURL
+			}
+
+			if a.Content != "" {
+				if item.Content == nil {
+					item.Content = &AtomContent{}
+				}
+
+				item.Content.Type = "html"
+				item.Content.Content = a.Content
+			}
+		}
+
+		content := ""
+		if item.Content != nil {
+			content = item.Content.Content
+		}
+
+		if !fr.filter.enoughWords(content) {
+			continue
+		}
+
+		atom.Entries = append(atom.Entries, item)
 		if a == nil {
 			continue
 		}
 
-		if a.FinalURL != "" {
-			item.Link.Href = a.FinalURL
+		ais = append(ais, fr.atomToArchive(item))
+
+		fr.t.title = item.Title
+		fr.t.url = item.Link.Href
+		addTracking(&item.Content.Content, fr)
+	}
+
+	archiveItems(fr.feedKey(), ais)
+
+	if fr.archive > 0 {
+		if entries, err := fr.archivedAtomEntries(); err == nil {
+			atom.Entries = entries
 		}
+	}
+
+	requestLogFrom(ctx).addItems(len(atom.Entries))
+}
+
+func handleJSONFeed(ctx context.Context, jf *JSONFeed, fr feedRequest) (string, error) {
+	processJSONFeed(ctx, jf, fr)
+	return jsonEncode(jf)
+}
+
+func processJSONFeed(ctx context.Context, jf *JSONFeed, fr feedRequest) {
+	fr.t.title = jf.Title
+	track(fr)
+
+	if jf.Favicon == "" {
+		jf.Favicon = faviconURL(fr.baseURL.Host)
+	}
+
+	var ais []*archivedItem
+	items := fr.filter.jsonItems(jf.Items)
+	jf.Items = items[:0]
+
+	for _, item := range items {
+		a := getArticle(ctx, item.Url, fr.articleCredential(item.Url))
 
-		if a.Content != "" {
-			if item.Content == nil {
-				item.Content = &AtomContent{}
+		// Don't modify if something went wrong
+		if a != nil {
+			if a.FinalURL != "" {
+				item.Url = a.FinalURL
+			}
+
+			if a.Content != "" {
+				item.ContentHTML = a.Content
+				item.ContentText = ""
 			}
+		}
+
+		if !fr.filter.enoughWords(item.ContentHTML + item.ContentText) {
+			continue
+		}
 
-			item.Content.Type = "html"
-			item.Content.Content = a.Content
+		jf.Items = append(jf.Items, item)
+		if a == nil {
+			continue
 		}
 
+		ais = append(ais, fr.jsonToArchive(item))
+
 		fr.t.title = item.Title
-		fr.t.url = item.Link.Href
-		addTracking(&item.Content.Content, fr)
+		fr.t.url = item.Url
+		addTracking(&item.ContentHTML, fr)
 	}
 
-	return xmlEncode(atom)
+	archiveItems(fr.feedKey(), ais)
+
+	if fr.archive > 0 {
+		if items, err := fr.archivedJSONItems(); err == nil {
+			jf.Items = items
+		}
+	}
+
+	requestLogFrom(ctx).addItems(len(jf.Items))
+}
+
+// articleCredential hands userinfo from the feed URL to articles on the same
+// host only; everything else falls back to the credential store.
+func (fr feedRequest) articleCredential(link string) *credential {
+	cred, bu := credentialFromURL(fr.baseURL)
+	if cred == nil {
+		return nil
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || !strings.EqualFold(u.Host, bu.Host) {
+		return nil
+	}
+
+	return cred
 }
 
 func xmlEncode(v interface{}) (string, error) {
@@ -360,6 +853,29 @@ func xmlEncode(v interface{}) (string, error) {
 	return string(res), nil
 }
 
+// jsonEncode leaves HTML alone: feed content is HTML and readers don't need it
+// mangled into \u003c escapes.
+func jsonEncode(v interface{}) (string, error) {
+	var b bytes.Buffer
+
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+func feedContentType(feed string) string {
+	if strings.HasPrefix(feed, "{") {
+		return "application/feed+json; charset=utf-8"
+	}
+
+	return "text/xml; charset=utf-8"
+}
+
 func urlAsPath(u url.URL) string {
 	u.Scheme = ""
 	u.Opaque = ""
@@ -398,9 +914,28 @@ func getTrackingURL(fr feedRequest, includeIP bool, isFeedHit bool) string {
 		ip)
 }
 
+// track reports a feed hit. Hits are dropped rather than piling up when
+// the tracker is slow.
 func track(fr feedRequest) {
+	if fr.t.disabled {
+		return
+	}
+
+	select {
+	case trackers <- struct{}{}:
+	default:
+		return
+	}
+
 	go func() {
-		body, err := httpGet(getTrackingURL(fr, true, true))
+		defer func() { <-trackers }()
+
+		// The hit outlives the request that caused it
+		ctx, cancel := context.WithTimeout(serverCtx, trackTimeout)
+		defer cancel()
+		ctx = withFetchScope(ctx, scopeOwn)
+
+		body, err := httpGet(ctx, getTrackingURL(fr, true, true))
 		if err == nil {
 			body.Close()
 		}
@@ -408,26 +943,9 @@ func track(fr feedRequest) {
 }
 
 func addTracking(content *string, fr feedRequest) {
-	*content += fmt.Sprintf("<img src=\"%s\"/>", getTrackingURL(fr, false, false))
-}
-
-func checkLandingPage(u *url.URL, content string) (redirectURL string) {
-	// Well, maybe we're looking at a landing page...
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
-	if err != nil {
+	if fr.t.disabled {
 		return
 	}
 
-	feedHref, _ := doc.FindMatcher(linkAlt).Attr("href")
-	if feedHref == "" {
-		return
-	}
-
-	feedURL, err := url.Parse(feedHref)
-	if err != nil {
-		return
-	}
-
-	redirectURL = u.ResolveReference(feedURL).String()
-	return
+	*content += fmt.Sprintf("<img src=\"%s\"/>", getTrackingURL(fr, false, false))
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bundle is a saved set of feeds that can be subscribed to by name.
+type bundle struct {
+	Title string   `json:"title"`
+	URLs  []string `json:"urls"`
+}
+
+type mergeSource struct {
+	title string
+	link  string
+	items []*RssItem
+	err   error
+}
+
+const (
+	maxMergedFeeds = 10
+)
+
+var (
+	bundlesFile = ""
+
+	errTooManyFeeds = fmt.Errorf("too many feeds: at most %d may be merged", maxMergedFeeds)
+)
+
+// readBundles reads a JSON object mapping bundle names to bundles.
+func readBundles(path string) (map[string]*bundle, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := map[string]*bundle{}
+	err = json.Unmarshal(b, &bs)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, b := range bs {
+		if len(b.URLs) == 0 {
+			return nil, fmt.Errorf("bundle %s has no urls", name)
+		}
+	}
+
+	return bs, nil
+}
+
+func lookupBundle(name string) *bundle {
+	return getConfig().bundles[name]
+}
+
+// handleMerged fetches and extracts every feed concurrently, then
+// interleaves everything into a single RSS feed, newest first.
+func handleMerged(ctx context.Context, frs []feedRequest, title string) (string, error) {
+	if len(frs) > maxMergedFeeds {
+		return "", errTooManyFeeds
+	}
+
+	filter := frs[0].filter.merged()
+	srcs := make([]mergeSource, len(frs))
+
+	var wg sync.WaitGroup
+	for i, fr := range frs {
+		fr.filter = fr.filter.perSource()
+
+		wg.Add(1)
+		go func(src *mergeSource, fr feedRequest) {
+			defer wg.Done()
+			*src = loadMergeSource(ctx, fr)
+		}(&srcs[i], fr)
+	}
+	wg.Wait()
+
+	rss, err := mergeSources(srcs, title)
+	if err != nil {
+		return "", err
+	}
+
+	rss.Channel.Items = filter.rssItems(rss.Channel.Items)
+	requestLogFrom(ctx).setItems(len(rss.Channel.Items))
+
+	if rss.Channel.Image == nil {
+		rss.Channel.Image = &RssImage{
+			Title: rss.Channel.Title,
+			Link:  rss.Channel.Link,
+			Url:   faviconURL(frs[0].baseURL.Host),
+		}
+	}
+
+	return xmlEncode(rss)
+}
+
+func loadMergeSource(ctx context.Context, fr feedRequest) (src mergeSource) {
+	f, redirectURL, err := fetchFeed(ctx, fr)
+
+	// There's no sending the client anywhere, so follow landing pages here
+	if err == nil && redirectURL != "" {
+		fr.baseURL, err = url.Parse(redirectURL)
+		if err == nil {
+			f, redirectURL, err = fetchFeed(ctx, fr)
+		}
+
+		if err == nil && redirectURL != "" {
+			err = errInvalidPage
+		}
+	}
+
+	if err != nil {
+		src.err = err
+		return
+	}
+
+	switch f := f.(type) {
+	case *Rss:
+		processRss(ctx, f, fr)
+		src.title = f.Channel.Title
+		src.link = f.Channel.Link
+		src.items = f.Channel.Items
+
+	case *Atom:
+		processAtom(ctx, f, fr)
+		src.title = f.Title
+		if f.Link != nil {
+			src.link = f.Link.Href
+		}
+		src.items = atomToRssItems(f)
+
+	case *JSONFeed:
+		processJSONFeed(ctx, f, fr)
+		src.title = f.Title
+		src.link = f.HomePageUrl
+		src.items = jsonFeedToRssItems(f)
+	}
+
+	return
+}
+
+// mergeSources combines sources, dropping any item whose GUID or (final) link
+// has already been seen. Sources that failed are skipped unless they all did.
+func mergeSources(srcs []mergeSource, title string) (*Rss, error) {
+	var titles []string
+	var items []*RssItem
+	var err error
+
+	ch := &RssFeed{}
+	seen := map[string]bool{}
+
+	for _, src := range srcs {
+		if src.err != nil {
+			err = src.err
+			continue
+		}
+
+		titles = append(titles, src.title)
+		if ch.Link == "" {
+			ch.Link = src.link
+		}
+
+		for _, item := range src.items {
+			if (item.Guid != "" && seen[item.Guid]) ||
+				(item.Link != "" && seen[item.Link]) {
+				continue
+			}
+
+			seen[item.Guid] = true
+			seen[item.Link] = true
+
+			items = append(items, item)
+		}
+	}
+
+	if len(titles) == 0 {
+		return nil, err
+	}
+
+	dates := make(map[*RssItem]time.Time, len(items))
+	for _, item := range items {
+		dates[item] = rssItemDate(item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return dates[items[i]].After(dates[items[j]])
+	})
+
+	ch.Title = title
+	if ch.Title == "" {
+		ch.Title = strings.Join(titles, " + ")
+	}
+
+	ch.Description = "Combined from: " + strings.Join(titles, ", ")
+	ch.Items = items
+
+	return &Rss{
+		Version: "2.0",
+		Channel: ch,
+	}, nil
+}
+
+func atomToRssItems(atom *Atom) (items []*RssItem) {
+	for _, e := range atom.Entries {
+		item := &RssItem{
+			Title: e.Title,
+			Guid:  e.Id,
+		}
+
+		for _, c := range e.Categories {
+			item.Categories = append(item.Categories, c.Term)
+		}
+
+		if e.Link != nil {
+			item.Link = e.Link.Href
+		}
+
+		if e.Content != nil {
+			item.Description = e.Content.Content
+		} else if e.Summary != nil {
+			item.Description = e.Summary.Content
+		}
+
+		if e.Author != nil {
+			item.Author = e.Author.Name
+		}
+
+		item.PubDate = e.Published
+		if item.PubDate == "" {
+			item.PubDate = e.Updated
+		}
+		item.PubDate = rssDate(item.PubDate)
+
+		items = append(items, item)
+	}
+
+	return
+}
+
+func jsonFeedToRssItems(jf *JSONFeed) (items []*RssItem) {
+	for _, ji := range jf.Items {
+		item := &RssItem{
+			Title:   ji.Title,
+			Link:    ji.Url,
+			Guid:    ji.Id,
+			PubDate: rssDate(ji.PublishedDate),
+		}
+
+		switch {
+		case ji.ContentHTML != "":
+			item.Description = ji.ContentHTML
+		case ji.ContentText != "":
+			item.Description = ji.ContentText
+		default:
+			item.Description = ji.Summary
+		}
+
+		if ji.Author != nil {
+			item.Author = ji.Author.Name
+		}
+
+		item.Categories = ji.Tags
+
+		items = append(items, item)
+	}
+
+	return
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Opml struct {
+	XMLName xml.Name  `xml:"opml"`
+	Version string    `xml:"version,attr"`
+	Head    *OpmlHead `xml:"head"`
+	Body    *OpmlBody `xml:"body"`
+}
+
+type OpmlHead struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type OpmlBody struct {
+	Outlines []*OpmlOutline `xml:"outline"`
+}
+
+type OpmlOutline struct {
+	Text     string         `xml:"text,attr"`
+	Title    string         `xml:"title,attr,omitempty"`
+	Type     string         `xml:"type,attr,omitempty"`
+	XmlUrl   string         `xml:"xmlUrl,attr,omitempty"`
+	HtmlUrl  string         `xml:"htmlUrl,attr,omitempty"`
+	Outlines []*OpmlOutline `xml:"outline"`
+}
+
+// feeds lists every outline that's a feed, however deeply nested.
+func (o *Opml) feeds() (feeds []*OpmlOutline) {
+	if o.Body == nil {
+		return
+	}
+
+	var walk func(outlines []*OpmlOutline)
+	walk = func(outlines []*OpmlOutline) {
+		for _, ol := range outlines {
+			if ol.XmlUrl != "" {
+				feeds = append(feeds, ol)
+			}
+
+			walk(ol.Outlines)
+		}
+	}
+
+	walk(o.Body.Outlines)
+	return
+}
+
+// Options that are about the OPML itself rather than the feeds in it
+var opmlParams = []string{"opml", "unwrap"}
+
+// opmlHandler takes an uploaded OPML file and points every feed in it at
+// OhMyRSS, passing along any feed options, and key, in the query string.
+// With unwrap=1, it does the opposite.
+func opmlHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "upload an OPML file", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, getConfig().MaxResponseBytes)
+
+	var in io.Reader = req.Body
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := req.FormFile("opml")
+		if err != nil {
+			http.Error(w, "missing opml file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+
+		in = f
+	}
+
+	opml := &Opml{}
+	err := xml.NewDecoder(in).Decode(opml)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid OPML: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	opts := req.URL.Query()
+	for _, p := range opmlParams {
+		opts.Del(p)
+	}
+
+	// Don't hand out URLs that are only going to fail
+	check := &http.Request{Form: opts}
+	if _, err := parseScrapeOptions(check); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := parseItemFilter(check); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	self := url.URL{
+		Scheme: "http",
+		Host:   req.Host,
+		Path:   strings.TrimSuffix(req.URL.Path, "opml") + "feed",
+	}
+
+	if req.TLS != nil {
+		self.Scheme = "https"
+	}
+
+	unwrap := req.URL.Query().Get("unwrap") != ""
+
+	// Handing out URLs that need a key, or a signature, is the same as
+	// letting the caller in
+	keyHash := requestKeyHash(req)
+	if !unwrap {
+		if getConfig().SignedOnly && lookupAPIKey(keyHash) == nil {
+			http.Error(w, errAPIKeyRequired.Error(), http.StatusForbidden)
+			return
+		}
+
+		_, release, ok := admitRequest(w, req, keyHash, nil)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	for _, ol := range opml.feeds() {
+		if unwrap {
+			ol.XmlUrl = unwrapFeedURL(ol.XmlUrl, self)
+			continue
+		}
+
+		ol.XmlUrl, err = wrapFeedURL(ol.XmlUrl, self, opts, keyHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	out, err := xml.MarshalIndent(opml, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Add("Content-Disposition", `attachment; filename="ohmyrss.opml"`)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// wrapFeedURL points a feed at OhMyRSS, unless it already is. When this
+// server signs URLs, the URL is signed for the key given.
+func wrapFeedURL(feedURL string, self url.URL, opts url.Values, keyHash string) (string, error) {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Host == self.Host {
+		return feedURL, nil
+	}
+
+	q := url.Values{}
+	for k, vs := range opts {
+		q[k] = vs
+	}
+	q.Set("url", feedURL)
+
+	if getConfig().TokenSecret != "" {
+		token, err := signFeedQuery(q, keyHash)
+		if err != nil {
+			return "", err
+		}
+
+		self.Path = strings.TrimSuffix(self.Path, "feed") + "f/" + token
+		return self.String(), nil
+	}
+
+	self.RawQuery = q.Encode()
+	return self.String(), nil
+}
+
+// unwrapFeedURL gets back the original feed from a URL pointing at this
+// server's /feed, one of its signed URLs, or the root that feeds used to be
+// served from. Anything else is left alone: plenty of feeds have a url parameter of their own.
+func unwrapFeedURL(feedURL string, self url.URL) string {
+	u, err := url.Parse(feedURL)
+	if err != nil || !strings.EqualFold(u.Host, self.Host) {
+		return feedURL
+	}
+
+	q := u.Query()
+	legacy := strings.TrimSuffix(self.Path, "feed")
+	switch {
+	case u.Path == self.Path || u.Path == legacy:
+	case strings.HasPrefix(u.Path, legacy+"f/"):
+		q, _, err = verifyToken(strings.TrimPrefix(u.Path, legacy+"f/"))
+		if err != nil {
+			return feedURL
+		}
+	default:
+		return feedURL
+	}
+
+	orig := q.Get("url")
+	if ou, err := url.Parse(orig); err != nil || ou.Host == "" {
+		return feedURL
+	}
+
+	return orig
+}
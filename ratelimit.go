@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A rateLimiter hands out requests from a bucket per key that refills at a
+// steady rate.
+type rateLimiter struct {
+	mtx     sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	rateSweepInterval = time.Minute
+)
+
+var (
+	ipLimiter   = newRateLimiter()
+	hostLimiter = newRateLimiter()
+
+	// Set up from the config on start
+	requestSlots chan struct{}
+)
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// allow takes a request from key's bucket, which holds up to burst requests
+// and gets perMinute more every minute. If there's nothing left, it says how
+// long until there is.
+func (rl *rateLimiter) allow(key string, perMinute float64, burst int, now time.Time) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+
+	perSec := perMinute / 60
+	full := float64(burst)
+	if full < 1 {
+		full = 1
+	}
+
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if now.Sub(rl.swept) >= rateSweepInterval {
+		rl.sweep(perSec, full, now)
+	}
+
+	b := rl.buckets[key]
+	if b == nil {
+		b = &rateBucket{
+			tokens: full,
+			last:   now,
+		}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(full, b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / perSec
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled: they're no different from new
+// ones.
+func (rl *rateLimiter) sweep(perSec, full float64, now time.Time) {
+	for k, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*perSec >= full {
+			delete(rl.buckets, k)
+		}
+	}
+
+	rl.swept = now
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+
+		// A lone address is a network of one
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", c)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+
+			nets = append(nets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func (c *config) trustsProxy(ip string) bool {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return false
+	}
+
+	for _, n := range c.trustedNets {
+		if n.Contains(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitRequest decides if a client may have us fetch from some hosts right
+// now. When it may, release must be called once the request is done;
+// otherwise, the client has already been told to come back later.
+func limitRequest(w http.ResponseWriter, req *http.Request, hosts []string) (release func(), ok bool) {
+	c := getConfig()
+	now := time.Now()
+
+	ok, wait := ipLimiter.allow(httpGetRemoteIP(req), c.IPRate, c.IPBurst, now)
+	for _, h := range hosts {
+		if !ok {
+			break
+		}
+
+		ok, wait = hostLimiter.allow(strings.ToLower(h), c.HostRate, c.HostBurst, now)
+	}
+
+	if !ok {
+		tooManyRequests(w, wait)
+		return nil, false
+	}
+
+	if requestSlots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case requestSlots <- struct{}{}:
+		return func() { <-requestSlots }, true
+	default:
+		tooManyRequests(w, time.Second)
+		return nil, false
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -57,7 +57,8 @@ type RssItem struct {
 	Link        string   `xml:"link"`        // required
 	Description string   `xml:"description"` // required
 	Author      string   `xml:"author,omitempty"`
-	Category    string   `xml:"category,omitempty"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator,omitempty"`
+	Categories  []string `xml:"category,omitempty"`
 	Comments    string   `xml:"comments,omitempty"`
 	Enclosure   *RssEnclosure
 	Guid        string `xml:"guid,omitempty"`    // Id used
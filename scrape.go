@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// scrapeOptions describes how to build a feed out of a plain HTML listing
+// page. Any selector left nil is guessed.
+type scrapeOptions struct {
+	item  cascadia.Selector
+	title cascadia.Selector
+	link  cascadia.Selector
+	date  cascadia.Selector
+}
+
+const (
+	maxScrapedItems = 30
+
+	// Link text shorter than this is probably "Read more" or a tag, not a title
+	minScrapedTitleLen = 10
+
+	// How many blocks must repeat before we believe it's a listing
+	minScrapedRepeats = 3
+)
+
+var (
+	errNoListing = errors.New("could not find a list of articles on this page")
+
+	selArticle = cascadia.MustCompile("article")
+	selHeading = cascadia.MustCompile("h1 a[href], h2 a[href], h3 a[href], h4 a[href]")
+	selAnchor  = cascadia.MustCompile("a[href]")
+	selTime    = cascadia.MustCompile("time")
+	selMetaDsc = cascadia.MustCompile("meta[name=description][content]")
+)
+
+// parseScrapeOptions pulls scrape settings from a request. Scraping happens
+// when explicitly asked for or when any selector is given.
+func parseScrapeOptions(req *http.Request) (*scrapeOptions, error) {
+	so := &scrapeOptions{}
+	enabled := req.FormValue("scrape") != ""
+
+	sels := []struct {
+		param string
+		sel   *cascadia.Selector
+	}{
+		{"item", &so.item},
+		{"title", &so.title},
+		{"link", &so.link},
+		{"date", &so.date},
+	}
+
+	for _, s := range sels {
+		v := req.FormValue(s.param)
+		if v == "" {
+			continue
+		}
+
+		sel, err := cascadia.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s selector: %s", s.param, err)
+		}
+
+		*s.sel = sel
+		enabled = true
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	return so, nil
+}
+
+// scrapeFeed builds an RSS feed from the repeated article blocks of a
+// listing page.
+func scrapeFeed(u *url.URL, content string, so *scrapeOptions) (*Rss, error) {
+	// Links are resolved against the page; don't let credentials ride along
+	_, u = credentialFromURL(u)
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*RssItem
+	if so.item != nil {
+		doc.FindMatcher(so.item).Each(func(i int, s *goquery.Selection) {
+			if item := scrapeItem(u, s, so); item != nil {
+				items = append(items, item)
+			}
+		})
+	} else {
+		items = guessItems(u, doc, so)
+	}
+
+	if len(items) == 0 {
+		return nil, errNoListing
+	}
+
+	if len(items) > maxScrapedItems {
+		items = items[:maxScrapedItems]
+	}
+
+	title := strings.TrimSpace(doc.Find("title").First().Text())
+	if title == "" {
+		title = u.Host
+	}
+
+	desc, _ := doc.FindMatcher(selMetaDsc).Attr("content")
+	if desc == "" {
+		desc = title
+	}
+
+	return &Rss{
+		Version: "2.0",
+		Channel: &RssFeed{
+			Title:       title,
+			Link:        u.String(),
+			Description: strings.TrimSpace(desc),
+			Items:       items,
+		},
+	}, nil
+}
+
+func scrapeItem(u *url.URL, s *goquery.Selection, so *scrapeOptions) *RssItem {
+	var a *goquery.Selection
+	if so.link != nil {
+		a = s.FindMatcher(so.link).First()
+	} else if goquery.NodeName(s) == "a" {
+		a = s
+	} else {
+		a = s.FindMatcher(selHeading).First()
+		if a.Length() == 0 {
+			a = s.FindMatcher(selAnchor).First()
+		}
+	}
+
+	href, ok := a.Attr("href")
+	if !ok {
+		return nil
+	}
+
+	link, err := u.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return nil
+	}
+
+	title := ""
+	if so.title != nil {
+		title = s.FindMatcher(so.title).First().Text()
+	} else {
+		title = a.Text()
+	}
+	title = strings.Join(strings.Fields(title), " ")
+
+	var ds *goquery.Selection
+	if so.date != nil {
+		ds = s.FindMatcher(so.date).First()
+	} else {
+		ds = s.FindMatcher(selTime).First()
+	}
+
+	return &RssItem{
+		Title:   title,
+		Link:    link.String(),
+		Guid:    link.String(),
+		PubDate: scrapeDate(ds),
+	}
+}
+
+func scrapeDate(s *goquery.Selection) string {
+	if s.Length() == 0 {
+		return ""
+	}
+
+	d, ok := s.Attr("datetime")
+	if !ok {
+		d = s.Text()
+	}
+
+	t, ok := parseDate(d)
+	if !ok {
+		return ""
+	}
+
+	return t.Format(time.RFC1123Z)
+}
+
+// guessItems finds the most-repeated block of links on the page: <article>s
+// if there are enough of them, otherwise links that share the same position
+// in the document's structure.
+func guessItems(u *url.URL, doc *goquery.Document, so *scrapeOptions) (items []*RssItem) {
+	seen := map[string]bool{}
+	add := func(item *RssItem) {
+		if item != nil && item.Title != "" && !seen[item.Link] {
+			seen[item.Link] = true
+			items = append(items, item)
+		}
+	}
+
+	arts := doc.FindMatcher(selArticle)
+	if arts.Length() >= minScrapedRepeats {
+		arts.Each(func(i int, s *goquery.Selection) {
+			add(scrapeItem(u, s, so))
+		})
+
+		return
+	}
+
+	groups := map[string][]*goquery.Selection{}
+	doc.FindMatcher(selAnchor).Each(func(i int, s *goquery.Selection) {
+		text := strings.TrimSpace(s.Text())
+		if len(text) < minScrapedTitleLen {
+			return
+		}
+
+		sig := nodeSignature(s)
+		groups[sig] = append(groups[sig], s)
+	})
+
+	sigs := make([]string, 0, len(groups))
+	for sig, links := range groups {
+		if len(links) >= minScrapedRepeats {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	if len(sigs) == 0 {
+		return
+	}
+
+	sort.Slice(sigs, func(i, j int) bool {
+		a, b := groups[sigs[i]], groups[sigs[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+
+		return sigs[i] < sigs[j]
+	})
+
+	for _, s := range groups[sigs[0]] {
+		item := scrapeItem(u, s, so)
+		if item != nil && item.PubDate == "" {
+			// Dates tend to live next to the link, not inside it
+			item.PubDate = scrapeDate(s.Parent().Parent().FindMatcher(selTime).First())
+		}
+
+		add(item)
+	}
+
+	return
+}
+
+// nodeSignature describes where a node sits in the document: each
+// ancestor's tag and classes. Links in the same list share a signature.
+func nodeSignature(s *goquery.Selection) string {
+	var parts []string
+	for n := s; n.Length() > 0 && goquery.NodeName(n) != "body"; n = n.Parent() {
+		part := goquery.NodeName(n)
+		if class, ok := n.Attr("class"); ok {
+			cs := strings.Fields(class)
+			sort.Strings(cs)
+			part += "." + strings.Join(cs, ".")
+		}
+
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, "<")
+}
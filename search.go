@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/boltdb/bolt"
+)
+
+// An indexedDoc is an article as the search index knows it.
+type indexedDoc struct {
+	URL     string
+	Title   string
+	Content string
+	Indexed time.Time
+
+	// Kept so that postings can be cleaned up when the doc is reindexed
+	Terms []string
+}
+
+type searchResult struct {
+	*indexedDoc
+	score uint32
+}
+
+// A searchHit is a match, before its doc is loaded.
+type searchHit struct {
+	url     string
+	score   uint32
+	indexed int64
+}
+
+const (
+	maxSearchResults = 50
+	snippetLen       = 300
+
+	// Articles waiting to be indexed; past that, they're dropped
+	indexQueueLen = 256
+	maxIndexBatch = 64
+)
+
+var (
+	indexPath   = ""
+	searchIndex *bolt.DB
+
+	indexMtx   sync.RWMutex
+	indexQueue chan *article
+	indexDone  chan struct{}
+
+	errNoIndex    = errors.New("search disabled")
+	errEmptyQuery = errors.New("missing q parameter")
+
+	// url -> indexedDoc
+	bucketDocs = []byte("docs")
+
+	// term -> (url -> term frequency + when the doc was indexed)
+	bucketTerms = []byte("terms")
+
+	searchPage = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<head>
+	<title>OhMyRSS: {{ .Query }}</title>
+	<meta http-equiv="content-type" content="text/html; charset=utf-8"/>
+	<link rel="alternate" type="application/rss+xml" title="{{ .Query }}" href="{{ .FeedURL }}">
+</head>
+<body>
+	<form action="" method="get">
+		<input name="q" type="text" value="{{ .Query }}" autofocus />
+		<input type="submit" value="Search" />
+		<a href="{{ .FeedURL }}">Subscribe</a>
+	</form>
+	{{ range .Results }}
+	<div class="result">
+		<h3><a href="{{ .URL }}">{{ if .Title }}{{ .Title }}{{ else }}{{ .URL }}{{ end }}</a></h3>
+		<p>{{ .Snippet }}</p>
+	</div>
+	{{ else }}
+	<p>Nothing found.</p>
+	{{ end }}
+</body>`))
+)
+
+func openIndex(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketDocs, bucketTerms} {
+			_, err := tx.CreateBucketIfNotExists(b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	searchIndex = db
+
+	indexMtx.Lock()
+	indexQueue = make(chan *article, indexQueueLen)
+	indexDone = make(chan struct{})
+	go indexWorker(db, indexQueue, indexDone)
+	indexMtx.Unlock()
+
+	return nil
+}
+
+// closeIndex writes out whatever's still queued, then closes the index.
+func closeIndex() {
+	if searchIndex == nil {
+		return
+	}
+
+	indexMtx.Lock()
+	close(indexQueue)
+	indexQueue = nil
+	indexMtx.Unlock()
+
+	<-indexDone
+	searchIndex.Close()
+	searchIndex = nil
+}
+
+// tokenize splits text into lowercase words, dropping anything too short to
+// be worth searching for.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	toks := words[:0]
+	for _, w := range words {
+		if len(w) > 1 {
+			toks = append(toks, w)
+		}
+	}
+
+	return toks
+}
+
+func htmlText(html string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return html
+	}
+
+	return doc.Text()
+}
+
+// indexArticle queues an article to be added to the search index,
+// replacing whatever was indexed for its URL before. Nobody waits on the
+// index: if it can't keep up, articles go unindexed.
+func indexArticle(a *article) {
+	if a == nil || a.FinalURL == "" {
+		return
+	}
+
+	indexMtx.RLock()
+	defer indexMtx.RUnlock()
+
+	if indexQueue == nil {
+		return
+	}
+
+	select {
+	case indexQueue <- a:
+	default:
+	}
+}
+
+// indexWorker writes queued articles to the index, as many at once as have
+// piled up. Failures are ignored: search is a nicety.
+func indexWorker(db *bolt.DB, queue <-chan *article, done chan<- struct{}) {
+	defer close(done)
+
+	for a := range queue {
+		batch := []*article{a}
+
+	more:
+		for len(batch) < maxIndexBatch {
+			select {
+			case a, ok := <-queue:
+				if !ok {
+					break more
+				}
+
+				batch = append(batch, a)
+			default:
+				break more
+			}
+		}
+
+		db.Update(func(tx *bolt.Tx) error {
+			for _, a := range batch {
+				err := putIndexedDoc(tx, a)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+}
+
+func putIndexedDoc(tx *bolt.Tx, a *article) error {
+	freqs := map[string]uint32{}
+	for _, t := range tokenize(a.Title + " " + a.FinalURL + " " + htmlText(a.Content)) {
+		freqs[t]++
+	}
+
+	doc := &indexedDoc{
+		URL:     a.FinalURL,
+		Title:   a.Title,
+		Content: a.Content,
+		Indexed: time.Now(),
+	}
+
+	for t := range freqs {
+		doc.Terms = append(doc.Terms, t)
+	}
+
+	docs := tx.Bucket(bucketDocs)
+	terms := tx.Bucket(bucketTerms)
+	key := []byte(doc.URL)
+
+	if old := decodeIndexedDoc(docs.Get(key)); old != nil {
+		for _, t := range old.Terms {
+			if tb := terms.Bucket([]byte(t)); tb != nil {
+				tb.Delete(key)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(doc)
+	if err != nil {
+		return err
+	}
+
+	err = docs.Put(key, b.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for t, n := range freqs {
+		tb, err := terms.CreateBucketIfNotExists([]byte(t))
+		if err != nil {
+			return err
+		}
+
+		// Enough to rank on without loading any docs
+		var f [12]byte
+		binary.BigEndian.PutUint32(f[:4], n)
+		binary.BigEndian.PutUint64(f[4:], uint64(doc.Indexed.UnixNano()))
+
+		err = tb.Put(key, f[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeIndexedDoc(v []byte) *indexedDoc {
+	if v == nil {
+		return nil
+	}
+
+	var doc indexedDoc
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(&doc)
+	if err != nil {
+		return nil
+	}
+
+	return &doc
+}
+
+// search finds articles containing every word of the query, best matches
+// first, newest first among equals.
+func search(q string) (res []searchResult, err error) {
+	if searchIndex == nil {
+		return nil, errNoIndex
+	}
+
+	toks := tokenize(q)
+	if len(toks) == 0 {
+		return nil, errEmptyQuery
+	}
+
+	err = searchIndex.View(func(tx *bolt.Tx) error {
+		terms := tx.Bucket(bucketTerms)
+
+		var hits map[string]*searchHit
+		for _, t := range toks {
+			tb := terms.Bucket([]byte(t))
+			if tb == nil {
+				return nil
+			}
+
+			next := map[string]*searchHit{}
+			tb.ForEach(func(k, v []byte) error {
+				if len(v) < 12 {
+					return nil
+				}
+
+				url := string(k)
+				freq := binary.BigEndian.Uint32(v[:4])
+
+				if hits == nil {
+					next[url] = &searchHit{
+						url:     url,
+						score:   freq,
+						indexed: int64(binary.BigEndian.Uint64(v[4:])),
+					}
+				} else if h, ok := hits[url]; ok {
+					h.score += freq
+					next[url] = h
+				}
+
+				return nil
+			})
+
+			hits = next
+		}
+
+		// Docs are big, so only the ones that make the cut are loaded
+		ranked := make([]*searchHit, 0, len(hits))
+		for _, h := range hits {
+			ranked = append(ranked, h)
+		}
+
+		sort.Slice(ranked, func(i, j int) bool {
+			if ranked[i].score != ranked[j].score {
+				return ranked[i].score > ranked[j].score
+			}
+
+			return ranked[i].indexed > ranked[j].indexed
+		})
+
+		if len(ranked) > maxSearchResults {
+			ranked = ranked[:maxSearchResults]
+		}
+
+		docs := tx.Bucket(bucketDocs)
+		for _, h := range ranked {
+			if doc := decodeIndexedDoc(docs.Get([]byte(h.url))); doc != nil {
+				res = append(res, searchResult{
+					indexedDoc: doc,
+					score:      h.score,
+				})
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (r searchResult) Snippet() string {
+	text := strings.Join(strings.Fields(htmlText(r.Content)), " ")
+	if len(text) <= snippetLen {
+		return text
+	}
+
+	// Don't cut a multi-byte character in half
+	cut := snippetLen
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	return text[:cut] + "…"
+}
+
+func searchHandler(w http.ResponseWriter, req *http.Request) {
+	q := strings.TrimSpace(req.FormValue("q"))
+
+	res, err := search(q)
+	if err == errEmptyQuery && req.FormValue("format") != "rss" {
+		err = nil
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.FormValue("format") == "rss" {
+		feed, err := searchFeed(req, q, res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", feedContentType(feed))
+		w.Write([]byte(feed))
+		return
+	}
+
+	fu := *req.URL
+	fq := fu.Query()
+	fq.Set("format", "rss")
+	fu.RawQuery = fq.Encode()
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	searchPage.Execute(w, struct {
+		Query   string
+		FeedURL string
+		Results []searchResult
+	}{
+		Query:   q,
+		FeedURL: fu.String(),
+		Results: res,
+	})
+}
+
+func searchFeed(req *http.Request, q string, res []searchResult) (string, error) {
+	self := *req.URL
+	self.Host = req.Host
+	self.Scheme = "http"
+	if req.TLS != nil {
+		self.Scheme = "https"
+	}
+
+	ch := &RssFeed{
+		Title:       "OhMyRSS: " + q,
+		Link:        self.String(),
+		Description: "Articles matching " + q,
+	}
+
+	for _, r := range res {
+		ch.Items = append(ch.Items, &RssItem{
+			Title:       r.Title,
+			Link:        r.URL,
+			Guid:        r.URL,
+			Description: r.Content,
+			PubDate:     r.Indexed.Format(time.RFC1123Z),
+		})
+	}
+
+	return xmlEncode(&Rss{
+		Version: "2.0",
+		Channel: ch,
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A certReloader serves a certificate, picking up new ones as they're
+// written to disk.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+const (
+	certCheckInterval = 10 * time.Second
+)
+
+var (
+	// Every request is served under this; it's cancelled once the server
+	// stops waiting for in-flight requests to finish
+	serverCtx, cancelServer = context.WithCancel(context.Background())
+)
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	_, err := cr.reload()
+	return cr, err
+}
+
+// reload loads the certificate again if it changed on disk, which must be
+// called with mtx held.
+func (cr *certReloader) reload() (bool, error) {
+	var modTime time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	cr.checked = time.Now()
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+	return true, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+
+	if time.Since(cr.checked) >= certCheckInterval {
+		// Half-written files are common while certs are being renewed:
+		// keep using the old one until the new one makes sense
+		reloaded, err := cr.reload()
+		if err != nil {
+			logEvent(logError, "tls: failed to reload certificate, keeping the old one", map[string]interface{}{
+				"error": err.Error(),
+			})
+		} else if reloaded {
+			logEvent(logInfo, "tls: reloaded certificate", nil)
+		}
+	}
+
+	return cr.cert, nil
+}
+
+// listen opens the listener a server config asks for.
+func listen(c serverConfig) (net.Listener, error) {
+	addr := c.Listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", c.HTTPPort)
+	}
+
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a crash would stop us from ever starting
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+func newServer(c serverConfig, h http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           h,
+		ReadTimeout:       c.ReadTimeout.Duration,
+		ReadHeaderTimeout: c.ReadHeaderTimeout.Duration,
+		WriteTimeout:      c.WriteTimeout.Duration,
+		IdleTimeout:       c.IdleTimeout.Duration,
+		BaseContext: func(net.Listener) context.Context {
+			return serverCtx
+		},
+	}
+
+	if c.TLSCert != "" {
+		cr, err := newCertReloader(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %s", err)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: cr.getCertificate,
+		}
+	}
+
+	return srv, nil
+}
+
+// serve runs the server until it's told to stop.
+func serve(c serverConfig) error {
+	// However requests arrive, there are only so many at once
+	if c.MaxConcurrent > 0 {
+		requestSlots = make(chan struct{}, c.MaxConcurrent)
+	}
+
+	if c.Fcgi {
+		return fcgi.Serve(nil, nil)
+	}
+
+	srv, err := newServer(c, http.DefaultServeMux)
+	if err != nil {
+		return err
+	}
+
+	l, err := listen(c)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	return runServer(srv, l, stop, c.ShutdownTimeout.Duration)
+}
+
+// runServer serves on l until stop fires, then waits up to timeout for
+// in-flight requests to finish before cancelling their extractions.
+func runServer(
+	srv *http.Server,
+	l net.Listener,
+	stop <-chan os.Signal,
+	timeout time.Duration) error {
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ServeTLS(l, "", "")
+		} else {
+			errs <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		logEvent(logInfo, "server: draining", map[string]interface{}{
+			"signal": sig.String(),
+		})
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := srv.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		logEvent(logWarn, "server: gave up draining, cancelling extractions", nil)
+		cancelServer()
+		err = srv.Close()
+	}
+
+	if serr := <-errs; serr != http.ErrServerClosed && err == nil {
+		err = serr
+	}
+
+	return err
+}
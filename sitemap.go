@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"time"
+)
+
+type SitemapNews struct {
+	Title           string `xml:"title"`
+	PublicationDate string `xml:"publication_date"`
+}
+
+type SitemapURL struct {
+	Loc     string       `xml:"loc"`
+	LastMod string       `xml:"lastmod"`
+	News    *SitemapNews `xml:"news"`
+}
+
+type Sitemap struct {
+	XMLName xml.Name      `xml:"urlset"`
+	URLs    []*SitemapURL `xml:"url"`
+}
+
+type SitemapIndex struct {
+	XMLName  xml.Name      `xml:"sitemapindex"`
+	Sitemaps []*SitemapURL `xml:"sitemap"`
+}
+
+const (
+	maxSitemapItems = 20
+
+	// Indexes can list hundreds of sitemaps; only the freshest matter
+	maxSitemapIndexFetch = 3
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	errGzipTooLarge = errors.New("gzipped content too large")
+)
+
+// maybeGunzip handles sitemap.xml.gz and friends, which are served as-is
+// rather than with a Content-Encoding. Decompressed, they're held to the
+// same limit as any response.
+func maybeGunzip(in []byte) ([]byte, error) {
+	if !bytes.HasPrefix(in, gzipMagic) {
+		return in, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return in, nil
+	}
+	defer zr.Close()
+
+	max := getConfig().MaxResponseBytes
+	out, err := ioutil.ReadAll(io.LimitReader(zr, max+1))
+	if err != nil {
+		return in, nil
+	}
+
+	if int64(len(out)) > max {
+		return nil, errGzipTooLarge
+	}
+
+	return out, nil
+}
+
+func (su *SitemapURL) date() time.Time {
+	if su.News != nil {
+		if t, ok := parseDate(su.News.PublicationDate); ok {
+			return t
+		}
+	}
+
+	t, _ := parseDate(su.LastMod)
+	return t
+}
+
+// newestSitemapURLs sorts newest first and keeps the top n.
+func newestSitemapURLs(urls []*SitemapURL, n int) []*SitemapURL {
+	type dated struct {
+		su *SitemapURL
+		t  time.Time
+	}
+
+	// Dates take some parsing, so only do it once per URL
+	ds := make([]dated, len(urls))
+	for i, su := range urls {
+		ds[i] = dated{su, su.date()}
+	}
+
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].t.After(ds[j].t)
+	})
+
+	if len(ds) > n {
+		ds = ds[:n]
+	}
+
+	newest := make([]*SitemapURL, len(ds))
+	for i, d := range ds {
+		newest[i] = d.su
+	}
+
+	return newest
+}
+
+func sitemapIndexToRss(ctx context.Context, smi *SitemapIndex, fr feedRequest) (*Rss, error) {
+	sm := &Sitemap{}
+
+	var err error
+	for _, child := range newestSitemapURLs(smi.Sitemaps, maxSitemapIndexFetch) {
+		var cu *url.URL
+		cu, err = fr.baseURL.Parse(child.Loc)
+		if err != nil {
+			continue
+		}
+
+		var csm Sitemap
+		err = fetchSitemap(ctx, cu, &csm)
+		if err != nil {
+			continue
+		}
+
+		sm.URLs = append(sm.URLs, csm.URLs...)
+	}
+
+	if len(sm.URLs) == 0 {
+		if err == nil {
+			err = errInvalidPage
+		}
+
+		return nil, err
+	}
+
+	return sitemapToRss(sm, fr), nil
+}
+
+func fetchSitemap(ctx context.Context, u *url.URL, sm *Sitemap) error {
+	body, err := httpGetURL(ctx, u, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	in, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	in, err = maybeGunzip(in)
+	if err != nil {
+		return err
+	}
+
+	return xml.Unmarshal(in, sm)
+}
+
+func sitemapToRss(sm *Sitemap, fr feedRequest) *Rss {
+	_, bu := credentialFromURL(fr.baseURL)
+	site := url.URL{
+		Scheme: bu.Scheme,
+		Host:   bu.Host,
+		Path:   "/",
+	}
+
+	rss := &Rss{
+		Version: "2.0",
+		Channel: &RssFeed{
+			Title:       bu.Host,
+			Link:        site.String(),
+			Description: "Latest from " + bu.Host,
+		},
+	}
+
+	for _, su := range newestSitemapURLs(sm.URLs, maxSitemapItems) {
+		item := &RssItem{
+			Link: su.Loc,
+			Guid: su.Loc,
+		}
+
+		if su.News != nil {
+			item.Title = su.News.Title
+		}
+
+		if t := su.date(); !t.IsZero() {
+			item.PubDate = t.Format(time.RFC1123Z)
+		}
+
+		rss.Channel.Items = append(rss.Channel.Items, item)
+	}
+
+	return rss
+}
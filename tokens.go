@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// feedAuth is what a feed request has to show for itself.
+type feedAuth struct {
+	// The request came from a token this server signed
+	signed bool
+
+	// Hash of the API key the request was made, or the token minted, with
+	keyHash string
+}
+
+const (
+	tokenSigBytes  = 16
+	tokenKeyParam  = "kh"
+	maxTokenQuery  = 64 << 10
+	minTokenSecret = 16
+)
+
+var (
+	errNoTokenSecret = errors.New("signed URLs are disabled")
+	errBadToken      = errors.New("invalid token")
+	errUnsigned      = errors.New("only signed feed URLs are served here")
+)
+
+func tokenMAC(secret string, b []byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(b)
+	return m.Sum(nil)[:tokenSigBytes]
+}
+
+// signFeedQuery packs a feed's query, and the key it's being used with, into
+// a token that can't be changed without the server noticing. Tokens are
+// compressed rather than encrypted: they're opaque to readers, not secret.
+func signFeedQuery(q url.Values, keyHash string) (string, error) {
+	secret := getConfig().TokenSecret
+	if secret == "" {
+		return "", errNoTokenSecret
+	}
+
+	sq := url.Values{}
+	for k, vs := range q {
+		if k != "key" && k != tokenKeyParam {
+			sq[k] = vs
+		}
+	}
+
+	if keyHash != "" {
+		sq.Set(tokenKeyParam, keyHash)
+	}
+
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+
+	zw.Write([]byte(sq.Encode()))
+	err = zw.Close()
+	if err != nil {
+		return "", err
+	}
+
+	b := append(tokenMAC(secret, buf.Bytes()), buf.Bytes()...)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// verifyToken unpacks a token made by signFeedQuery.
+func verifyToken(token string) (q url.Values, keyHash string, err error) {
+	secret := getConfig().TokenSecret
+	if secret == "" {
+		err = errNoTokenSecret
+		return
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) <= tokenSigBytes {
+		err = errBadToken
+		return
+	}
+
+	sig, z := b[:tokenSigBytes], b[tokenSigBytes:]
+	if !hmac.Equal(sig, tokenMAC(secret, z)) {
+		err = errBadToken
+		return
+	}
+
+	zr := flate.NewReader(bytes.NewReader(z))
+	defer zr.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(zr, maxTokenQuery))
+	if err != nil {
+		err = errBadToken
+		return
+	}
+
+	q, err = url.ParseQuery(string(raw))
+	if err != nil {
+		err = errBadToken
+		return
+	}
+
+	keyHash = q.Get(tokenKeyParam)
+	q.Del(tokenKeyParam)
+
+	return
+}
+
+// signHandler mints a signed URL for the feed, and options, it's given,
+// taking the same parameters as feedHandler.
+func signHandler(w http.ResponseWriter, req *http.Request) {
+	if getConfig().TokenSecret == "" {
+		http.Error(w, errNoTokenSecret.Error(), http.StatusNotFound)
+		return
+	}
+
+	req.ParseForm()
+
+	feedURLs := req.Form["url"]
+	if name := req.FormValue("bundle"); name != "" {
+		b := lookupBundle(name)
+		if b == nil {
+			http.Error(w, "unknown bundle", http.StatusNotFound)
+			return
+		}
+
+		feedURLs = b.URLs
+	}
+
+	if len(feedURLs) == 0 || feedURLs[0] == "" {
+		http.Error(w, "missing url parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Don't sign anything that's only going to fail
+	var hosts []string
+	for _, feedURL := range feedURLs {
+		u, err := parseFeedURL(feedURL)
+		if err != nil || u.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+
+		_, err = parseFeedRequest(req, u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !getConfig().FeedHosts.allows(u) {
+			http.Error(w, errFeedRefused.Error(), http.StatusForbidden)
+			return
+		}
+
+		hosts = append(hosts, u.Host)
+	}
+
+	// When tokens are the only way in, handing them out is the same as
+	// letting anyone in
+	keyHash := requestKeyHash(req)
+	if getConfig().SignedOnly && lookupAPIKey(keyHash) == nil {
+		http.Error(w, errAPIKeyRequired.Error(), http.StatusForbidden)
+		return
+	}
+
+	_, release, ok := admitRequest(w, req, keyHash, hosts)
+	if !ok {
+		return
+	}
+	defer release()
+
+	token, err := signFeedQuery(req.Form, keyHash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	self := url.URL{
+		Scheme: "http",
+		Host:   req.Host,
+		Path:   strings.TrimSuffix(req.URL.Path, "sign") + "f/" + token,
+	}
+
+	if req.TLS != nil {
+		self.Scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(self.String() + "\n"))
+}
+
+// tokenHandler serves the feed behind a signed URL, /f/<token>. Anything in
+// the query string is ignored: the token says it all.
+func tokenHandler(w http.ResponseWriter, req *http.Request) {
+	q, keyHash, err := verifyToken(path.Base(req.URL.Path))
+	if err == errNoTokenSecret {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	req.URL.RawQuery = q.Encode()
+	req.Form = nil
+
+	serveFeed(w, req, feedAuth{
+		signed:  true,
+		keyHash: keyHash,
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+)
+
+type previewItem struct {
+	Title     string
+	Link      string
+	FinalURL  string
+	Original  string
+	Extracted string
+}
+
+type previewPage struct {
+	Title   string
+	FeedURL string
+	Items   []*previewItem
+}
+
+var (
+	//go:embed static
+	staticFiles embed.FS
+
+	staticHandler http.Handler
+
+	previewTmpl = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<head>
+	<title>OhMyRSS: {{ .Title }}</title>
+	<meta http-equiv="content-type" content="text/html; charset=utf-8"/>
+	<style>
+	body {
+		background: #aeaeae;
+		font-family: Georgia, Serif;
+	}
+
+	.item {
+		background: #ededed;
+		border-radius: 15px;
+		border: 3px solid #414141;
+		margin: 15px auto;
+		padding: 15px;
+	}
+
+	.cols {
+		display: flex;
+	}
+
+	.cols div {
+		flex: 1;
+		margin: 0 5px;
+	}
+
+	iframe {
+		background: #fff;
+		border: 1px solid #414141;
+		height: 400px;
+		width: 100%;
+	}
+	</style>
+</head>
+<body>
+	<h1>{{ .Title }}</h1>
+	<p><a href="{{ .FeedURL }}">Subscribe to the full-text feed</a></p>
+	{{ range .Items }}
+	<div class="item">
+		<h2>{{ .Title }}</h2>
+		<p>
+			Original link: <a href="{{ .Link }}">{{ .Link }}</a><br/>
+			Extracted from: <a href="{{ .FinalURL }}">{{ .FinalURL }}</a>
+		</p>
+		<div class="cols">
+			<div>
+				<h3>In the feed</h3>
+				<iframe sandbox srcdoc="{{ .Original }}"></iframe>
+			</div>
+			<div>
+				<h3>Extracted</h3>
+				<iframe sandbox srcdoc="{{ .Extracted }}"></iframe>
+			</div>
+		</div>
+	</div>
+	{{ end }}
+</body>`))
+)
+
+func init() {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	staticHandler = http.FileServer(http.FS(sub))
+}
+
+// previewHandler shows what a feed looks like once it's been through
+// OhMyRSS, next to what it looked like before. It takes the same parameters
+// as feedHandler.
+func previewHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	u, err := parseFeedURL(req.FormValue("url"))
+	if err != nil || u.Host == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	fr, err := parseFeedRequest(req, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Nobody's reading anything, just looking
+	fr.t.disabled = true
+
+	if getConfig().SignedOnly {
+		http.Error(w, errUnsigned.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx, release, ok := admitRequest(w, req, requestKeyHash(req), []string{u.Host})
+	if !ok {
+		return
+	}
+	defer release()
+
+	f, redirectURL, err := fetchFeed(ctx, fr)
+	if err == errFeedRefused {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if mf, ok := err.(*multipleFeedsError); ok {
+		serveChooser(w, req, feedAuth{}, mf.feeds)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if redirectURL != "" {
+		q := req.URL.Query()
+		q.Set("url", redirectURL)
+		req.URL.RawQuery = q.Encode()
+		http.Redirect(w, req, req.URL.String(), http.StatusFound)
+		return
+	}
+
+	// Relative, so it still works from behind a proxy that mounts us elsewhere
+	feedURL := url.URL{
+		Path:     "feed",
+		RawQuery: req.URL.RawQuery,
+	}
+
+	page := previewPage{
+		FeedURL: feedURL.String(),
+		Items:   previewItems(ctx, f, fr),
+	}
+
+	switch f := f.(type) {
+	case *Rss:
+		page.Title = f.Channel.Title
+	case *Atom:
+		page.Title = f.Title
+	case *JSONFeed:
+		page.Title = f.Title
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	previewTmpl.Execute(w, page)
+}
+
+// previewItems processes a feed, remembering each item's link and content
+// from before extraction.
+func previewItems(ctx context.Context, f interface{}, fr feedRequest) (items []*previewItem) {
+	switch f := f.(type) {
+	case *Rss:
+		orig := map[*RssItem]*previewItem{}
+		for _, item := range f.Channel.Items {
+			orig[item] = &previewItem{
+				Link:     item.Link,
+				Original: item.Description,
+			}
+		}
+
+		processRss(ctx, f, fr)
+
+		for _, item := range f.Channel.Items {
+			pi := orig[item]
+			if pi == nil {
+				pi = &previewItem{}
+			}
+
+			pi.Title = item.Title
+			pi.FinalURL = item.Link
+			pi.Extracted = item.Description
+			items = append(items, pi)
+		}
+
+	case *Atom:
+		orig := map[*AtomEntry]*previewItem{}
+		for _, e := range f.Entries {
+			pi := &previewItem{}
+			if e.Link != nil {
+				pi.Link = e.Link.Href
+			}
+
+			if e.Content != nil {
+				pi.Original = e.Content.Content
+			} else if e.Summary != nil {
+				pi.Original = e.Summary.Content
+			}
+
+			orig[e] = pi
+		}
+
+		processAtom(ctx, f, fr)
+
+		for _, e := range f.Entries {
+			pi := orig[e]
+			if pi == nil {
+				pi = &previewItem{}
+			}
+
+			pi.Title = e.Title
+			if e.Link != nil {
+				pi.FinalURL = e.Link.Href
+			}
+
+			if e.Content != nil {
+				pi.Extracted = e.Content.Content
+			}
+
+			items = append(items, pi)
+		}
+
+	case *JSONFeed:
+		orig := map[*JSONItem]*previewItem{}
+		for _, item := range f.Items {
+			pi := &previewItem{
+				Link:     item.Url,
+				Original: item.ContentHTML,
+			}
+
+			if pi.Original == "" {
+				pi.Original = template.HTMLEscapeString(item.ContentText)
+			}
+
+			orig[item] = pi
+		}
+
+		processJSONFeed(ctx, f, fr)
+
+		for _, item := range f.Items {
+			pi := orig[item]
+			if pi == nil {
+				pi = &previewItem{}
+			}
+
+			pi.Title = item.Title
+			pi.FinalURL = item.Url
+			pi.Extracted = item.ContentHTML
+			items = append(items, pi)
+		}
+	}
+
+	return
+}